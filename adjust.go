@@ -0,0 +1,379 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// adjustment is a single step of the image adjustment chain,
+// e.g. 'contrast=1.2', 'invert' or 'duotone=#123:#fed'
+type adjustment struct {
+	spec  string
+	apply func(img *image.NRGBA) *image.NRGBA
+}
+
+// adjustments are applied in order, flag can be repeated or
+// contain several steps separated by comma
+type adjustments []adjustment
+
+func (a *adjustments) Set(value string) error {
+	for _, spec := range strings.Split(value, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		adj, err := parseAdjustment(spec)
+		if err != nil {
+			return err
+		}
+
+		*a = append(*a, adj)
+	}
+
+	return nil
+}
+
+func (a *adjustments) String() string {
+	specs := make([]string, len(*a))
+	for i, adj := range *a {
+		specs[i] = adj.spec
+	}
+
+	return strings.Join(specs, ",")
+}
+
+func (a *adjustments) IsCumulative() bool {
+	return true
+}
+
+func (a adjustments) apply(img image.Image) image.Image {
+	if len(a) == 0 {
+		return img
+	}
+
+	result := toNRGBA(img)
+	for _, adj := range a {
+		result = adj.apply(result)
+	}
+
+	return result
+}
+
+func parseAdjustment(spec string) (adjustment, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+
+	number := func() (float64, error) {
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return 0, errors.Errorf("adjustment '%s' needs a number, e.g. %s=1.2", name, name)
+		}
+		return v, nil
+	}
+
+	result := adjustment{spec: spec}
+
+	switch name {
+	case "brightness":
+		v, err := number()
+		if err != nil {
+			return result, err
+		}
+		result.apply = mapRGB(func(c float64) float64 {
+			return c + v*0xff
+		})
+
+	case "contrast":
+		v, err := number()
+		if err != nil {
+			return result, err
+		}
+		result.apply = mapRGB(func(c float64) float64 {
+			return (c-0x80)*v + 0x80
+		})
+
+	case "gamma":
+		v, err := number()
+		if err != nil {
+			return result, err
+		}
+		if v <= 0 {
+			return result, errors.New("gamma should be greater than 0")
+		}
+		result.apply = mapRGB(func(c float64) float64 {
+			return math.Pow(c/0xff, 1/v) * 0xff
+		})
+
+	case "saturation":
+		v, err := number()
+		if err != nil {
+			return result, err
+		}
+		result.apply = mapPixels(func(r, g, b float64) (float64, float64, float64) {
+			l := luminance(r, g, b)
+			return l + (r-l)*v, l + (g-l)*v, l + (b-l)*v
+		})
+
+	case "hue":
+		v, err := number()
+		if err != nil {
+			return result, err
+		}
+		result.apply = hueRotate(v)
+
+	case "invert":
+		result.apply = mapRGB(func(c float64) float64 {
+			return 0xff - c
+		})
+
+	case "grayscale":
+		result.apply = mapPixels(func(r, g, b float64) (float64, float64, float64) {
+			l := luminance(r, g, b)
+			return l, l, l
+		})
+
+	case "sepia":
+		result.apply = mapPixels(func(r, g, b float64) (float64, float64, float64) {
+			return 0.393*r + 0.769*g + 0.189*b,
+				0.349*r + 0.686*g + 0.168*b,
+				0.272*r + 0.534*g + 0.131*b
+		})
+
+	case "duotone", "gradient-map":
+		var colors []sdl.Color
+		for _, s := range strings.Split(arg, ":") {
+			var c color
+			if err := c.Set(s); err != nil {
+				return result, errors.Wrapf(err, "invalid %s color", name)
+			}
+			colors = append(colors, sdl.Color(c))
+		}
+		if len(colors) < 2 || (name == "duotone" && len(colors) != 2) {
+			return result, errors.Errorf("%s needs colors separated by ':', e.g. %s=#000:#fff", name, name)
+		}
+		result.apply = mapPixels(func(r, g, b float64) (float64, float64, float64) {
+			c := gradientAt(colors, luminance(r, g, b)/0xff)
+			return float64(c.R), float64(c.G), float64(c.B)
+		})
+
+	case "posterize":
+		v, err := number()
+		if err != nil {
+			return result, err
+		}
+		if v < 2 {
+			return result, errors.New("posterize needs at least 2 levels")
+		}
+		step := 0xff / (math.Floor(v) - 1)
+		result.apply = mapRGB(func(c float64) float64 {
+			return math.Round(c/step) * step
+		})
+
+	case "blur":
+		v, err := number()
+		if err != nil {
+			return result, err
+		}
+		result.apply = func(img *image.NRGBA) *image.NRGBA {
+			return blur(img, int(math.Round(v)))
+		}
+
+	case "sharpen":
+		v, err := number()
+		if err != nil {
+			return result, err
+		}
+		result.apply = func(img *image.NRGBA) *image.NRGBA {
+			return sharpen(img, v)
+		}
+
+	default:
+		return result, errors.Errorf("unknown adjustment '%s'", name)
+	}
+
+	return result, nil
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	if result, ok := img.(*image.NRGBA); ok && result.Bounds().Min == (image.Point{}) {
+		return result
+	}
+
+	bounds := img.Bounds()
+	result := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(result, result.Bounds(), img, bounds.Min, draw.Src)
+
+	return result
+}
+
+func luminance(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
+}
+
+func clamp8(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 0xff {
+		return 0xff
+	}
+	return uint8(v + 0.5)
+}
+
+// mapPixels applies fn to the color of every pixel, alpha is kept
+func mapPixels(fn func(r, g, b float64) (float64, float64, float64)) func(*image.NRGBA) *image.NRGBA {
+	return func(img *image.NRGBA) *image.NRGBA {
+		for i := 0; i < len(img.Pix); i += 4 {
+			r, g, b := fn(float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2]))
+			img.Pix[i] = clamp8(r)
+			img.Pix[i+1] = clamp8(g)
+			img.Pix[i+2] = clamp8(b)
+		}
+		return img
+	}
+}
+
+func mapRGB(fn func(c float64) float64) func(*image.NRGBA) *image.NRGBA {
+	return mapPixels(func(r, g, b float64) (float64, float64, float64) {
+		return fn(r), fn(g), fn(b)
+	})
+}
+
+// same matrix as css hue-rotate()
+func hueRotate(degrees float64) func(*image.NRGBA) *image.NRGBA {
+	rad := degrees * math.Pi / 180
+	cos, sin := math.Cos(rad), math.Sin(rad)
+
+	m := [9]float64{
+		0.213 + cos*0.787 - sin*0.213, 0.715 - cos*0.715 - sin*0.715, 0.072 - cos*0.072 + sin*0.928,
+		0.213 - cos*0.213 + sin*0.143, 0.715 + cos*0.285 + sin*0.140, 0.072 - cos*0.072 - sin*0.283,
+		0.213 - cos*0.213 - sin*0.787, 0.715 - cos*0.715 + sin*0.715, 0.072 + cos*0.928 + sin*0.072,
+	}
+
+	return mapPixels(func(r, g, b float64) (float64, float64, float64) {
+		return m[0]*r + m[1]*g + m[2]*b,
+			m[3]*r + m[4]*g + m[5]*b,
+			m[6]*r + m[7]*g + m[8]*b
+	})
+}
+
+// gradientAt interpolates evenly spaced colors, t is in [0, 1]
+func gradientAt(colors []sdl.Color, t float64) sdl.Color {
+	if len(colors) == 1 || t <= 0 {
+		return colors[0]
+	}
+	if t >= 1 {
+		return colors[len(colors)-1]
+	}
+
+	pos := t * float64(len(colors)-1)
+	i := int(pos)
+
+	return mixColor(colors[i], colors[i+1], pos-float64(i))
+}
+
+// mixColor linearly interpolates from a to b, t is in [0, 1]
+func mixColor(a, b sdl.Color, t float64) sdl.Color {
+	mix := func(x, y uint8) uint8 {
+		return clamp8(float64(x)*(1-t) + float64(y)*t)
+	}
+
+	return sdl.Color{
+		R: mix(a.R, b.R),
+		G: mix(a.G, b.G),
+		B: mix(a.B, b.B),
+		A: mix(a.A, b.A),
+	}
+}
+
+// blur approximates a gaussian blur with three box blur passes,
+// channels are premultiplied while blurring to avoid dark halos
+func blur(img *image.NRGBA, radius int) *image.NRGBA {
+	if radius <= 0 {
+		return img
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	buf := make([]float64, len(img.Pix))
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := float64(img.Pix[i+3]) / 0xff
+		buf[i] = float64(img.Pix[i]) * a
+		buf[i+1] = float64(img.Pix[i+1]) * a
+		buf[i+2] = float64(img.Pix[i+2]) * a
+		buf[i+3] = float64(img.Pix[i+3])
+	}
+
+	tmp := make([]float64, len(buf))
+	for pass := 0; pass < 3; pass++ {
+		boxBlur(buf, tmp, w, h, radius, 4, w*4)
+		boxBlur(tmp, buf, h, w, radius, w*4, 4)
+	}
+
+	result := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(buf); i += 4 {
+		a := buf[i+3]
+		result.Pix[i+3] = clamp8(a)
+		if a > 0 {
+			result.Pix[i] = clamp8(buf[i] * 0xff / a)
+			result.Pix[i+1] = clamp8(buf[i+1] * 0xff / a)
+			result.Pix[i+2] = clamp8(buf[i+2] * 0xff / a)
+		}
+	}
+
+	return result
+}
+
+// boxBlur blurs lines of n pixels, step is the distance between pixels of
+// a line and stride the distance between lines
+func boxBlur(src, dst []float64, n, lines, radius, step, stride int) {
+	size := float64(radius*2 + 1)
+
+	for line := 0; line < lines; line++ {
+		base := line * stride
+
+		for ch := 0; ch < 4; ch++ {
+			at := func(i int) float64 {
+				if i < 0 {
+					i = 0
+				} else if i >= n {
+					i = n - 1
+				}
+				return src[base+i*step+ch]
+			}
+
+			var sum float64
+			for i := -radius; i <= radius; i++ {
+				sum += at(i)
+			}
+
+			for i := 0; i < n; i++ {
+				dst[base+i*step+ch] = sum / size
+				sum += at(i+radius+1) - at(i-radius)
+			}
+		}
+	}
+}
+
+// sharpen is an unsharp mask with a small radius
+func sharpen(img *image.NRGBA, amount float64) *image.NRGBA {
+	blurred := blur(img, 1)
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		for ch := 0; ch < 3; ch++ {
+			c := float64(img.Pix[i+ch])
+			img.Pix[i+ch] = clamp8(c + (c-float64(blurred.Pix[i+ch]))*amount)
+		}
+	}
+
+	return img
+}
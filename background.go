@@ -0,0 +1,177 @@
+package main
+
+import (
+	"image"
+	imgcolor "image/color"
+	"image/draw"
+	"log"
+	"math"
+	"os"
+
+	"github.com/cj1128/codeposter/colorize"
+	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// background is what the poster is drawn on, bg color or a gradient,
+// with an optional image on top
+type background struct {
+	width, height int // poster size in pixels
+	img           *image.RGBA
+	scaleX        float64 // poster pixels per image pixel
+	scaleY        float64
+	offsetX       float64 // where the image starts on the poster
+	offsetY       float64
+}
+
+func checkBackground() error {
+	if config.bgOpacity < 0 || config.bgOpacity > 1 {
+		return errors.New("bg opacity should be between 0 and 1")
+	}
+
+	if config.format == "html" && (config.bgImage != "" || len(config.bgGradient) > 0) {
+		log.Println("background image and gradient are not drawn in html")
+	}
+
+	return nil
+}
+
+func newBackground(ctx *sdlContext) (*background, error) {
+	b := &background{width: ctx.winWidth, height: ctx.winHeight}
+	if config.bgImage == "" {
+		return b, nil
+	}
+
+	f, err := os.Open(config.bgImage)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open background image")
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode background image")
+	}
+
+	iw, ih := float64(img.Bounds().Dx()), float64(img.Bounds().Dy())
+	w, h := float64(b.width), float64(b.height)
+
+	b.scaleX, b.scaleY = 1, 1
+	switch config.bgFit {
+	case "cover":
+		b.scaleX = math.Max(w/iw, h/ih)
+		b.scaleY = b.scaleX
+	case "contain":
+		b.scaleX = math.Min(w/iw, h/ih)
+		b.scaleY = b.scaleX
+	case "stretch":
+		b.scaleX, b.scaleY = w/iw, h/ih
+	}
+
+	// downscale once with a good filter, sampling only interpolates
+	if b.scaleX < 1 || b.scaleY < 1 {
+		img = resize.Resize(uint(math.Max(1, math.Round(iw*b.scaleX))), uint(math.Max(1, math.Round(ih*b.scaleY))), img, resize.Lanczos3)
+		b.scaleX = b.scaleX * iw / float64(img.Bounds().Dx())
+		b.scaleY = b.scaleY * ih / float64(img.Bounds().Dy())
+	}
+
+	b.img = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(b.img, b.img.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	if config.bgFit != "tile" {
+		b.offsetX = (w - float64(b.img.Bounds().Dx())*b.scaleX) / 2
+		b.offsetY = (h - float64(b.img.Bounds().Dy())*b.scaleY) / 2
+	}
+
+	return b, nil
+}
+
+// uniform reports whether the background is just bg color
+func (b *background) uniform() bool {
+	return b.img == nil && len(config.bgGradient) == 0
+}
+
+// at returns the background color of a pixel in poster coordinates,
+// pixels outside the poster are in the bleed
+func (b *background) at(x, y int) sdl.Color {
+	result := sdl.Color(config.bgColor)
+	if len(config.bgGradient) > 0 {
+		result = gradientAt(config.bgGradient, gradientPosition(config.bgGradientType, config.bgAngle, b.width, b.height, x, y))
+	}
+
+	if b.img != nil {
+		c := b.sample((float64(x)+0.5-b.offsetX)/b.scaleX-0.5, (float64(y)+0.5-b.offsetY)/b.scaleY-0.5)
+		c.A = clamp8(float64(c.A) * config.bgOpacity)
+		result = sdl.Color(colorize.Over(imgcolor.NRGBA(c), imgcolor.NRGBA(result)))
+	}
+
+	return result
+}
+
+// sample interpolates the image at (u, v) in image pixels
+func (b *background) sample(u, v float64) sdl.Color {
+	w, h := b.img.Bounds().Dx(), b.img.Bounds().Dy()
+
+	switch config.bgFit {
+	case "contain", "center":
+		if u < -0.5 || v < -0.5 || u > float64(w)-0.5 || v > float64(h)-0.5 {
+			return sdl.Color{}
+		}
+	}
+
+	x0, y0 := int(math.Floor(u)), int(math.Floor(v))
+	fx, fy := u-float64(x0), v-float64(y0)
+
+	// tiles wrap around, other fits extend their edges into the bleed
+	index := func(x, y int) int {
+		if config.bgFit == "tile" {
+			return b.img.PixOffset(mod(x, w), mod(y, h))
+		}
+		return b.img.PixOffset(clampInt(x, 0, w-1), clampInt(y, 0, h-1))
+	}
+
+	i00, i10 := index(x0, y0), index(x0+1, y0)
+	i01, i11 := index(x0, y0+1), index(x0+1, y0+1)
+
+	// interpolate premultiplied values
+	var p [4]float64
+	for k := 0; k < 4; k++ {
+		top := float64(b.img.Pix[i00+k])*(1-fx) + float64(b.img.Pix[i10+k])*fx
+		bottom := float64(b.img.Pix[i01+k])*(1-fx) + float64(b.img.Pix[i11+k])*fx
+		p[k] = top*(1-fy) + bottom*fy
+	}
+
+	if p[3] == 0 {
+		return sdl.Color{}
+	}
+
+	return sdl.Color{
+		R: clamp8(p[0] * 0xff / p[3]),
+		G: clamp8(p[1] * 0xff / p[3]),
+		B: clamp8(p[2] * 0xff / p[3]),
+		A: clamp8(p[3]),
+	}
+}
+
+// draw fills dst, origin is where dst starts on the poster
+func (b *background) draw(dst *image.RGBA, origin image.Point) {
+	if b.uniform() {
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(imgcolor.NRGBA(config.bgColor)), image.Point{}, draw.Src)
+		return
+	}
+
+	bounds := dst.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := b.at(x+origin.X, y+origin.Y)
+			a := float64(c.A) / 0xff
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = clamp8(float64(c.R) * a)
+			dst.Pix[i+1] = clamp8(float64(c.G) * a)
+			dst.Pix[i+2] = clamp8(float64(c.B) * a)
+			dst.Pix[i+3] = c.A
+		}
+	}
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// batchJob is an entry of the manifest, keys are flag names plus
+// 'source' and optionally 'command'
+type batchJob struct {
+	line   int // in the manifest, for messages
+	fields []batchField
+}
+
+type batchField struct {
+	key    string
+	values []string
+}
+
+func (j *batchJob) add(key, value string) {
+	for i := range j.fields {
+		if j.fields[i].key == key {
+			j.fields[i].values = append(j.fields[i].values, value)
+			return
+		}
+	}
+	j.fields = append(j.fields, batchField{key, []string{value}})
+}
+
+func (j *batchJob) source() string {
+	for _, f := range j.fields {
+		if f.key == "source" {
+			return f.values[0]
+		}
+	}
+	return ""
+}
+
+// args turns the job into command line arguments, 'true' and 'false'
+// of bool flags become '--flag' and '--no-flag'
+func (j *batchJob) args() ([]string, error) {
+	var command, source []string
+	var flags []string
+
+	for _, f := range j.fields {
+		switch f.key {
+		case "command":
+			command = f.values
+			continue
+		case "source":
+			source = f.values
+			continue
+		}
+
+		for _, value := range f.values {
+			if isBoolFlag(f.key) {
+				switch value {
+				case "true":
+					flags = append(flags, "--"+f.key)
+				case "false":
+					flags = append(flags, "--no-"+f.key)
+				default:
+					return nil, errors.Errorf("line %d: %s should be true or false", j.line, f.key)
+				}
+				continue
+			}
+			flags = append(flags, "--"+f.key+"="+value)
+		}
+	}
+
+	if len(source) != 1 {
+		return nil, errors.Errorf("line %d: a job needs exactly one source", j.line)
+	}
+
+	return append(append(append(command, flags...), "--"), source...), nil
+}
+
+func isBoolFlag(name string) bool {
+	model := kingpin.CommandLine.Model()
+
+	groups := []*kingpin.FlagGroupModel{model.FlagGroupModel}
+	for _, cmd := range model.Commands {
+		groups = append(groups, cmd.FlagGroupModel)
+	}
+
+	for _, group := range groups {
+		for _, flag := range group.Flags {
+			if flag.Name == name {
+				return flag.IsBoolFlag()
+			}
+		}
+	}
+
+	return false
+}
+
+func readJobs(path string) ([]batchJob, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read jobs")
+	}
+
+	var jobs []batchJob
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		jobs, err = parseJobsCSV(content)
+	} else {
+		jobs, err = parseJobsYAML(content)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jobs) == 0 {
+		return nil, errors.New("there is no job in the manifest")
+	}
+
+	return jobs, nil
+}
+
+// parseJobsCSV takes the header as keys, a key may appear in several
+// columns for repeatable flags, empty cells are skipped
+func parseJobsCSV(content []byte) ([]batchJob, error) {
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse csv jobs")
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	var jobs []batchJob
+	for i, record := range records[1:] {
+		job := batchJob{line: i + 2}
+		for col, value := range record {
+			if value = strings.TrimSpace(value); value != "" {
+				job.add(strings.TrimSpace(header[col]), value)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// parseJobsYAML parses the subset of yaml needed by a manifest, a list
+// of mappings, optionally under a 'jobs' key, whose values are scalars,
+// flow lists like [a, b] or block lists, other yaml like block scalars,
+// anchors or nested mappings is an error instead of being misread
+func parseJobsYAML(content []byte) ([]batchJob, error) {
+	var (
+		jobs      []batchJob
+		job       *batchJob
+		jobIndent = -1
+		keyIndent = -1   // of the keys of the current job
+		listKey   string // key whose block list is being read
+		listLine  int    // of listKey, 0 once it has an item
+	)
+
+	// a key without value nor list items is most likely a value taken
+	// as a comment, e.g. '#fff' which has to be quoted
+	checkList := func() error {
+		if listKey != "" && listLine != 0 {
+			return errors.Errorf("line %d: %s has no value, quote values starting with '#'", listLine, listKey)
+		}
+		return nil
+	}
+
+	for i, raw := range strings.Split(string(content), "\n") {
+		line := stripYAMLComment(raw)
+		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "---" {
+			continue
+		}
+
+		fail := func(format string, args ...interface{}) ([]batchJob, error) {
+			return nil, errors.Errorf("line %d: %s", i+1, fmt.Sprintf(format, args...))
+		}
+
+		if strings.HasPrefix(strings.TrimLeft(line, " "), "\t") {
+			return fail("tabs can not be used for indentation")
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		text := strings.TrimSpace(line)
+
+		if indent == 0 && text == "jobs:" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(text, "-") && (jobIndent == -1 || indent == jobIndent):
+			// a new job
+			if err := checkList(); err != nil {
+				return nil, err
+			}
+			jobIndent = indent
+			jobs = append(jobs, batchJob{line: i + 1})
+			job = &jobs[len(jobs)-1]
+			listKey = ""
+			keyIndent = -1
+
+			rest := strings.TrimLeft(text[1:], " ")
+			if rest == "" {
+				continue
+			}
+			keyIndent = indent + len(text) - len(rest)
+			text = rest
+
+		case job == nil:
+			return fail("expected a list of jobs")
+
+		case strings.HasPrefix(text, "- ") && listKey != "":
+			item := strings.TrimSpace(text[2:])
+			if err := checkYAMLScalar(item); err != nil {
+				return fail("%v", err)
+			}
+			value, err := unquoteYAML(item)
+			if err != nil {
+				return fail("%v", err)
+			}
+			job.add(listKey, value)
+			listLine = 0
+			continue
+
+		case strings.HasPrefix(text, "-"):
+			return fail("list item without a key")
+
+		default:
+			if keyIndent == -1 {
+				keyIndent = indent
+			}
+			if indent > keyIndent {
+				return fail("nested mappings are not supported")
+			}
+			if indent < keyIndent {
+				return fail("unexpected indentation")
+			}
+		}
+
+		colon := strings.Index(text, ":")
+		if colon <= 0 {
+			return fail("expected 'key: value'")
+		}
+
+		key := strings.TrimSpace(text[:colon])
+		value := strings.TrimSpace(text[colon+1:])
+		if err := checkList(); err != nil {
+			return nil, err
+		}
+		listKey = ""
+
+		if key == "<<" {
+			return fail("merge keys are not supported")
+		}
+
+		switch {
+		case value == "":
+			listKey, listLine = key, i+1
+		case strings.HasPrefix(value, "["):
+			if !strings.HasSuffix(value, "]") {
+				return fail("flow lists have to be on one line")
+			}
+			for _, item := range splitYAMLFlow(value[1 : len(value)-1]) {
+				if item == "" {
+					continue
+				}
+				if err := checkYAMLScalar(item); err != nil {
+					return fail("%v", err)
+				}
+				v, err := unquoteYAML(item)
+				if err != nil {
+					return fail("%v", err)
+				}
+				job.add(key, v)
+			}
+		default:
+			if err := checkYAMLScalar(value); err != nil {
+				return fail("%v", err)
+			}
+			v, err := unquoteYAML(value)
+			if err != nil {
+				return fail("%v", err)
+			}
+			job.add(key, v)
+		}
+	}
+
+	if err := checkList(); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// checkYAMLScalar rejects yaml which is not a plain or quoted scalar
+func checkYAMLScalar(value string) error {
+	if value[0] == '"' || value[0] == '\'' {
+		return nil
+	}
+
+	switch value[0] {
+	case '|', '>':
+		return errors.New("block scalars are not supported, use a quoted string")
+	case '&', '*':
+		return errors.New("anchors and aliases are not supported")
+	case '!':
+		return errors.New("tags are not supported")
+	case '{':
+		return errors.New("flow mappings are not supported")
+	case '[':
+		return errors.New("nested lists are not supported")
+	}
+
+	if strings.Contains(value, ": ") || strings.HasSuffix(value, ":") {
+		return errors.New("nested mappings are not supported")
+	}
+
+	return nil
+}
+
+// stripYAMLComment removes '# ...' outside of quotes, '#' has to follow
+// a space like in yaml so 'a,#fff' is kept, '#fff' alone has to be quoted
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' '):
+			return strings.TrimRight(line[:i], " ")
+		}
+	}
+
+	return strings.TrimRight(line, " \r")
+}
+
+// splitYAMLFlow splits items of a flow list by commas outside of quotes
+func splitYAMLFlow(s string) []string {
+	var result []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			result = append(result, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+
+	return append(result, strings.TrimSpace(s[start:]))
+}
+
+// unquoteYAML removes quotes, ” is a quote in single quoted strings
+// and double quoted ones take backslash escapes
+func unquoteYAML(s string) (string, error) {
+	if len(s) == 0 || (s[0] != '"' && s[0] != '\'') {
+		return s, nil
+	}
+
+	if len(s) < 2 || s[len(s)-1] != s[0] {
+		return "", errors.Errorf("unterminated quoted string %s", s)
+	}
+
+	if s[0] == '\'' {
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+
+	value, err := strconv.Unquote(s)
+	if err != nil {
+		return "", errors.Errorf("invalid double quoted string %s", s)
+	}
+	return value, nil
+}
+
+// batchRequest and batchResponse are json lines between batch and its workers
+type batchRequest struct {
+	Args []string `json:"args"`
+}
+
+type batchResponse struct {
+	Output   string        `json:"output"`
+	Error    string        `json:"error"`
+	Duration time.Duration `json:"duration"`
+	Log      []string      `json:"log"` // messages logged while rendering, e.g. clipped captions
+}
+
+type batchResult struct {
+	job      batchJob
+	output   string
+	err      error
+	duration time.Duration
+	log      []string
+}
+
+// runBatch extracts the bundled font once and renders jobs with a pool
+// of worker processes, each of them initializes sdl once
+func runBatch() error {
+	jobs, err := readJobs(config.batchPath)
+	if err != nil {
+		return err
+	}
+
+	// check all jobs before starting
+	args := make([][]string, len(jobs))
+	for i := range jobs {
+		if args[i], err = jobs[i].args(); err != nil {
+			return err
+		}
+	}
+
+	if err := assignOutputs(jobs, args); err != nil {
+		return err
+	}
+
+	// jobs without --font share the font given to batch or the bundled one
+	fontPath := config.fontPath
+	if fontPath == "" {
+		if err := extractDefaultFont(); err != nil {
+			return err
+		}
+		fontPath = defaultFontPath
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "could not find executable")
+	}
+
+	workers := config.batchWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	log.Printf("batch: %d jobs, %d workers\n", len(jobs), workers)
+
+	var (
+		queue   = make(chan int)
+		results = make([]batchResult, len(jobs))
+		mu      sync.Mutex
+		done    int
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var w *batchWorker
+			for index := range queue {
+				result := batchResult{job: jobs[index]}
+
+				if w == nil {
+					w, result.err = startBatchWorker(executable, fontPath)
+				}
+
+				if w != nil {
+					resp, err := w.run(args[index])
+					if err != nil {
+						// the worker died, a new one takes the next job
+						w.stop()
+						w = nil
+					} else if resp.Error != "" {
+						err = errors.New(resp.Error)
+					}
+					result.output, result.err, result.duration, result.log = resp.Output, err, resp.Duration, resp.Log
+				}
+
+				mu.Lock()
+				results[index] = result
+				done++
+				if result.err != nil {
+					log.Printf("[%d/%d] failed %s (line %d): %v\n", done, len(jobs), result.job.source(), result.job.line, result.err)
+				} else {
+					log.Printf("[%d/%d] ok %s -> %s (%s)\n", done, len(jobs), result.job.source(), result.output, result.duration.Round(time.Millisecond))
+				}
+				for _, msg := range result.log {
+					log.Printf("  %s: %s\n", result.job.source(), msg)
+				}
+				mu.Unlock()
+			}
+
+			if w != nil {
+				w.stop()
+			}
+		}()
+	}
+
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	var failed []string
+	for _, result := range results {
+		if result.err != nil {
+			failed = append(failed, fmt.Sprintf("line %d %s: %v", result.job.line, result.job.source(), result.err))
+		}
+	}
+
+	log.Printf("batch done: %d succeeded, %d failed\n", len(jobs)-len(failed), len(failed))
+	if len(failed) > 0 {
+		return errors.Errorf("failed jobs:\n  %s", strings.Join(failed, "\n  "))
+	}
+
+	return nil
+}
+
+type batchWorker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+	stderr *bytes.Buffer
+}
+
+func startBatchWorker(executable, fontPath string) (*batchWorker, error) {
+	cmd := exec.Command(executable, "batch-worker", "--default-font="+fontPath)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not start worker")
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not start worker")
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "could not start worker")
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, 1<<20)
+
+	return &batchWorker{cmd, stdin, scanner, &stderr}, nil
+}
+
+func (w *batchWorker) run(args []string) (batchResponse, error) {
+	var resp batchResponse
+
+	if err := json.NewEncoder(w.stdin).Encode(batchRequest{args}); err != nil {
+		return resp, errors.Wrap(err, "could not send job to worker")
+	}
+
+	if !w.stdout.Scan() {
+		w.cmd.Wait()
+		if msg := lastLine(w.stderr.String()); msg != "" {
+			return resp, errors.Errorf("worker crashed: %s", msg)
+		}
+		return resp, errors.New("worker crashed")
+	}
+
+	if err := json.Unmarshal(w.stdout.Bytes(), &resp); err != nil {
+		return resp, errors.Wrap(err, "could not decode worker response")
+	}
+
+	return resp, nil
+}
+
+func (w *batchWorker) stop() {
+	w.stdin.Close()
+	w.cmd.Wait()
+}
+
+// runBatchWorker renders jobs read from stdin one after another, sdl,
+// ttf and fonts stay initialized between them, messages logged by a job
+// are sent back with its result as stdout carries the responses
+func runBatchWorker() error {
+	var messages bytes.Buffer
+	log.SetOutput(&messages)
+	log.SetFlags(0)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 1<<20)
+	encoder := json.NewEncoder(os.Stdout)
+
+	for scanner.Scan() {
+		var req batchRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return errors.Wrap(err, "could not decode job")
+		}
+
+		messages.Reset()
+		start := time.Now()
+		output, err := runJob(req.Args)
+
+		resp := batchResponse{Output: output, Duration: time.Since(start)}
+		if text := strings.TrimSpace(messages.String()); text != "" {
+			resp.Log = strings.Split(text, "\n")
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			return errors.Wrap(err, "could not send result")
+		}
+	}
+
+	return scanner.Err()
+}
+
+func runJob(args []string) (string, error) {
+	command, err := parseJob(args)
+	if err != nil {
+		return "", err
+	}
+
+	return runCommand(command)
+}
+
+// parseJob parses arguments of a job into a config rebuilt from
+// scratch, nothing set by an earlier job is kept, kingpin applies the
+// defaults of the flags
+func parseJob(args []string) (string, error) {
+	config = configuration{}
+
+	command, err := kingpin.CommandLine.Parse(args)
+	if err != nil {
+		return "", err
+	}
+
+	if command != "poster" && command != "postcard" {
+		return "", errors.Errorf("command %s can not be used in a batch", command)
+	}
+
+	return command, nil
+}
+
+// assignOutputs adds --output to jobs without one, workers render at
+// the same time so names are picked here instead of by checking which
+// files exist, sources with the same base name get different names
+func assignOutputs(jobs []batchJob, args [][]string) error {
+	saved := config
+	defer func() { config = saved }()
+
+	taken := make(map[string]int) // output to manifest line
+	exts := make([]string, len(jobs))
+
+	for i, job := range jobs {
+		command, err := parseJob(args[i])
+		if err != nil {
+			return errors.Wrapf(err, "line %d", job.line)
+		}
+
+		if config.output == "" {
+			exts[i] = config.format
+			if command == "postcard" {
+				exts[i] = "postcard.pdf"
+			}
+			continue
+		}
+
+		output := filepath.Clean(config.output)
+		if line, ok := taken[output]; ok {
+			return errors.Errorf("line %d: output %s is also written by line %d", job.line, config.output, line)
+		}
+		taken[output] = job.line
+	}
+
+	for i, job := range jobs {
+		if exts[i] == "" {
+			continue
+		}
+
+		output := uniqueOutputPath(filepath.Base(job.source()), exts[i], taken)
+		taken[output] = job.line
+
+		// flags go before '--' and the source
+		n := len(args[i]) - 2
+		args[i] = append(append(args[i][:n:n], "--output="+output), args[i][n:]...)
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+var initFlagsOnce sync.Once
+
+// setupFlags registers flags on the global kingpin app once for all tests
+func setupFlags() {
+	initFlagsOnce.Do(initFlags)
+}
+
+func TestParseJobRebuildsConfig(t *testing.T) {
+	setupFlags()
+	defer func(saved configuration) { config = saved }(config)
+
+	plain := []string{"poster", "--", "main.go"}
+	if _, err := parseJob(plain); err != nil {
+		t.Fatal(err)
+	}
+	want := config
+
+	dirty := [][]string{
+		{"poster", "--width=10", "--title=x", "--colorizer=syntax", "--adjust=invert", "--bg-gradient=#f00,#00f", "--layout=hex", "--crop-marks", "--", "other.go"},
+		{"postcard", "--to=Jane Doe", "--to=Shanghai", "--message=hi", "--", "other.go"},
+	}
+	for _, args := range dirty {
+		if _, err := parseJob(args); err != nil {
+			t.Fatal(err)
+		}
+
+		// set outside of flags while running a job
+		config.fontPath = "/tmp/font.ttf"
+
+		if _, err := parseJob(plain); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(config, want) {
+			t.Errorf("config after %v differs from a fresh one:\n got %+v\nwant %+v", args, config, want)
+		}
+	}
+}
+
+func TestParseJobRejectsCommands(t *testing.T) {
+	setupFlags()
+	defer func(saved configuration) { config = saved }(config)
+
+	if _, err := parseJob([]string{"batch", "jobs.csv"}); err == nil {
+		t.Error("batch command should not be accepted in a batch")
+	}
+}
+
+func TestAssignOutputs(t *testing.T) {
+	setupFlags()
+	defer func(saved configuration) { config = saved }(config)
+
+	dir, err := ioutil.TempDir("", "codeposter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// an existing file is skipped too
+	if err := ioutil.WriteFile("main.go.2.png", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := parseJobsCSV([]byte("source,output,command,format\na/main.go,,,\nb/main.go,,,\nc/main.go,main.go.png,,\nd/main.go,,postcard,\ne/main.go,,,tiff\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := make([][]string, len(jobs))
+	for i := range jobs {
+		if args[i], err = jobs[i].args(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := assignOutputs(jobs, args); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"main.go.1.png", "main.go.3.png", "main.go.png", "main.go.postcard.pdf", "main.go.tiff"}
+	for i, job := range args {
+		if _, err := parseJob(job); err != nil {
+			t.Fatal(err)
+		}
+		if config.output != want[i] {
+			t.Errorf("job %d: output %s, want %s", i, config.output, want[i])
+		}
+		if config.sourcePath != jobs[i].source() {
+			t.Errorf("job %d: source %s, want %s", i, config.sourcePath, jobs[i].source())
+		}
+	}
+}
+
+func TestAssignOutputsDuplicate(t *testing.T) {
+	setupFlags()
+	defer func(saved configuration) { config = saved }(config)
+
+	jobs, err := parseJobsCSV([]byte("source,output\nmain.go,x.png\nrender.go,./x.png\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := make([][]string, len(jobs))
+	for i := range jobs {
+		if args[i], err = jobs[i].args(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := assignOutputs(jobs, args); err == nil {
+		t.Error("two jobs writing the same output should fail")
+	}
+}
+
+func TestParseJobsYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    [][]batchField
+	}{
+		{
+			"jobs key",
+			"jobs:\n  - source: main.go\n    width: 80\n  - source: render.go\n",
+			[][]batchField{
+				{{"source", []string{"main.go"}}, {"width", []string{"80"}}},
+				{{"source", []string{"render.go"}}},
+			},
+		},
+		{
+			"top level list",
+			"- source: main.go\n- source: render.go\n",
+			[][]batchField{
+				{{"source", []string{"main.go"}}},
+				{{"source", []string{"render.go"}}},
+			},
+		},
+		{
+			"dash on its own line",
+			"-\n  source: main.go\n  title: x\n",
+			[][]batchField{
+				{{"source", []string{"main.go"}}, {"title", []string{"x"}}},
+			},
+		},
+		{
+			"block list",
+			"- source: main.go\n  to:\n    - Jane Doe\n    - Shanghai\n  width: 80\n",
+			[][]batchField{
+				{{"source", []string{"main.go"}}, {"to", []string{"Jane Doe", "Shanghai"}}, {"width", []string{"80"}}},
+			},
+		},
+		{
+			"block list at key indent",
+			"- source: main.go\n  to:\n  - Jane Doe\n  - Shanghai\n",
+			[][]batchField{
+				{{"source", []string{"main.go"}}, {"to", []string{"Jane Doe", "Shanghai"}}},
+			},
+		},
+		{
+			"flow list",
+			"- source: main.go\n  to: [Jane Doe, 'Shanghai, China', \"x\"]\n",
+			[][]batchField{
+				{{"source", []string{"main.go"}}, {"to", []string{"Jane Doe", "Shanghai, China", "x"}}},
+			},
+		},
+		{
+			"comments",
+			"# manifest\njobs: # all of them\n  - source: main.go # the main one\n    bg-color: '#fff'\n    title: issue#12\n    # width: 10\n---\n",
+			[][]batchField{
+				{{"source", []string{"main.go"}}, {"bg-color", []string{"#fff"}}, {"title", []string{"issue#12"}}},
+			},
+		},
+		{
+			"quoted values",
+			"- source: 'it''s.go'\n  title: \"a # b\"\n  subtitle: \"tab\\tand \\\"quote\\\"\"\n  footer: 'x: y'\n",
+			[][]batchField{
+				{{"source", []string{"it's.go"}}, {"title", []string{"a # b"}}, {"subtitle", []string{"tab\tand \"quote\""}}, {"footer", []string{"x: y"}}},
+			},
+		},
+		{
+			"repeated key",
+			"- source: main.go\n  adjust: invert\n  adjust: gamma=0.8\n",
+			[][]batchField{
+				{{"source", []string{"main.go"}}, {"adjust", []string{"invert", "gamma=0.8"}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		jobs, err := parseJobsYAML([]byte(test.content))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		var got [][]batchField
+		for _, job := range jobs {
+			got = append(got, job.fields)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseJobsYAMLUnsupported(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"literal block scalar", "- source: main.go\n  message: |\n    hello\n"},
+		{"folded block scalar", "- source: main.go\n  message: >-\n    hello\n"},
+		{"anchor", "- source: main.go\n  title: &name x\n"},
+		{"alias", "- source: main.go\n  title: *name\n"},
+		{"merge key", "- source: main.go\n  <<: *defaults\n"},
+		{"tag", "- source: main.go\n  width: !!int 80\n"},
+		{"nested mapping", "- source: main.go\n  options:\n    width: 80\n"},
+		{"nested mapping value", "- source: main.go\n  options: width: 80\n"},
+		{"mapping in block list", "- source: main.go\n  to:\n    - name: Jane\n"},
+		{"flow mapping", "- source: main.go\n  options: {width: 80}\n"},
+		{"multi-line flow list", "- source: main.go\n  to: [Jane,\n    Shanghai]\n"},
+		{"nested flow list", "- source: main.go\n  to: [[a, b]]\n"},
+		{"unterminated quote", "- source: 'main.go\n"},
+		{"tab indentation", "- source: main.go\n\twidth: 80\n"},
+		{"not a list", "source: main.go\n"},
+		{"list item without key", "- source: main.go\n    - x\n"},
+		{"unquoted color taken as comment", "- source: main.go\n  bg-color: #fff\n  width: 80\n"},
+		{"unquoted color at the end", "- source: main.go\n  bg-color: #fff\n"},
+	}
+
+	for _, test := range tests {
+		if _, err := parseJobsYAML([]byte(test.content)); err == nil {
+			t.Errorf("%s should fail", test.name)
+		}
+	}
+}
+
+func TestJobArgsBoolFlags(t *testing.T) {
+	setupFlags()
+
+	jobs, err := parseJobsYAML([]byte("- source: main.go\n  crop-marks: true\n  bg-flood: false\n  width: 80\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := jobs[0].args()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"--crop-marks", "--no-bg-flood", "--width=80", "--", "main.go"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("args %v, want %v", args, want)
+	}
+
+	jobs, err = parseJobsYAML([]byte("- source: main.go\n  crop-marks: yes\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs[0].args(); err == nil {
+		t.Error("bool flag with a value other than true or false should fail")
+	}
+}
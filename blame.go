@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	imgcolor "image/color"
+	"log"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+type blameLine struct {
+	author string
+	time   int64
+}
+
+// blame colors characters by the last change of their line,
+// either by age or by author
+type blame struct {
+	mode    string // age or author
+	lines   map[string]map[int]blameLine
+	authors map[string]sdl.Color
+
+	minTime, maxTime int64
+}
+
+type legendEntry struct {
+	text  string
+	color sdl.Color
+}
+
+func readBlame(mode string) (*blame, error) {
+	files, err := sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &blame{
+		mode:    mode,
+		lines:   make(map[string]map[int]blameLine),
+		minTime: math.MaxInt64,
+		maxTime: math.MinInt64,
+	}
+	authorLines := make(map[string]int)
+
+	for _, file := range files {
+		lines, err := gitBlame(file)
+		if err != nil {
+			if len(files) == 1 {
+				return nil, err
+			}
+			log.Printf("skip blame of %s: %v", file, err)
+			continue
+		}
+
+		result.lines[file] = lines
+		for _, line := range lines {
+			authorLines[line.author]++
+			if line.time < result.minTime {
+				result.minTime = line.time
+			}
+			if line.time > result.maxTime {
+				result.maxTime = line.time
+			}
+		}
+	}
+
+	if len(authorLines) == 0 {
+		return nil, errors.New("git blame found no lines in the source code")
+	}
+
+	// authors with more lines get the first hues
+	authors := make([]string, 0, len(authorLines))
+	for author := range authorLines {
+		authors = append(authors, author)
+	}
+	sort.Slice(authors, func(i, j int) bool {
+		if authorLines[authors[i]] != authorLines[authors[j]] {
+			return authorLines[authors[i]] > authorLines[authors[j]]
+		}
+		return authors[i] < authors[j]
+	})
+
+	result.authors = make(map[string]sdl.Color)
+	for i, author := range authors {
+		// golden angle keeps neighbouring hues apart
+		result.authors[author] = hslColor(math.Mod(float64(i)*137.508, 360), 0.65, 0.5)
+	}
+
+	return result, nil
+}
+
+// gitBlame runs git in the directory of file and returns blame info by line
+func gitBlame(file string) (map[int]blameLine, error) {
+	cmd := exec.Command("git", "blame", "--line-porcelain", "--", filepath.Base(file))
+	cmd.Dir = filepath.Dir(file)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not run git blame: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	result := make(map[int]blameLine)
+	var current blameLine
+	var lineNo int
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		text := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(text, "\t"):
+			result[lineNo] = current
+			current = blameLine{}
+			lineNo = 0
+		case strings.HasPrefix(text, "author "):
+			current.author = strings.TrimPrefix(text, "author ")
+		case strings.HasPrefix(text, "author-time "):
+			current.time, _ = strconv.ParseInt(strings.TrimPrefix(text, "author-time "), 10, 64)
+		case lineNo == 0:
+			// header: <sha> <original line> <final line> [<group lines>]
+			fields := strings.Fields(text)
+			if len(fields) >= 3 {
+				lineNo, _ = strconv.Atoi(fields[2])
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read git blame output")
+	}
+
+	return result, nil
+}
+
+func (b *blame) Color(cell Cell) imgcolor.NRGBA {
+	line, ok := b.lines[cell.File][cell.Line]
+	if !ok {
+		return imgcolor.NRGBA{}
+	}
+
+	if b.mode == "author" {
+		return imgcolor.NRGBA(b.authors[line.author])
+	}
+
+	t := 1.0
+	if b.maxTime > b.minTime {
+		t = float64(line.time-b.minTime) / float64(b.maxTime-b.minTime)
+	}
+
+	return imgcolor.NRGBA(gradientAt(config.blameColors, t))
+}
+
+func (b *blame) legend() []legendEntry {
+	if b.mode == "author" {
+		result := make([]legendEntry, 0, len(b.authors))
+		for author, color := range b.authors {
+			result = append(result, legendEntry{author, color})
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].text < result[j].text
+		})
+		return result
+	}
+
+	format := func(t int64) string {
+		return time.Unix(t, 0).Format("2006-01-02")
+	}
+
+	colors := config.blameColors
+	return []legendEntry{
+		{"old " + format(b.minTime), colors[0]},
+		{"new " + format(b.maxTime), colors[len(colors)-1]},
+	}
+}
+
+// legendItems lays out entries in one row of the bottom padding at y,
+// the legend is always logged since it may not fit
+func legendItems(ctx *sdlContext, entries []legendEntry, y int) ([]textItem, error) {
+	var parts []string
+	for _, entry := range entries {
+		parts = append(parts, fmt.Sprintf("%s #%02x%02x%02x", entry.text, entry.color.R, entry.color.G, entry.color.B))
+	}
+	log.Printf("legend: %s\n", strings.Join(parts, ", "))
+
+	if config.padding.vertical == 0 {
+		return nil, nil
+	}
+
+	x := config.padding.horizontal * ctx.charWidth
+	maxX := ctx.winWidth - config.padding.horizontal*ctx.charWidth
+
+	var result []textItem
+	for _, entry := range entries {
+		width, _, err := ctx.font.SizeUTF8(entry.text)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get size of legend")
+		}
+
+		if x+width > maxX {
+			log.Println("legend does not fit in the padding, truncated")
+			break
+		}
+
+		result = append(result, textItem{entry.text, entry.color, x, y, nil, 0})
+		x += width + 2*ctx.charWidth
+	}
+
+	return result, nil
+}
+
+// h in [0, 360), s and l in [0, 1]
+func hslColor(h, s, l float64) sdl.Color {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return sdl.Color{
+		R: clamp8((r + m) * 0xff),
+		G: clamp8((g + m) * 0xff),
+		B: clamp8((b + m) * 0xff),
+		A: 0xff,
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+	"github.com/veandco/go-sdl2/ttf"
+)
+
+// templateData is available to user templates
+type templateData struct {
+	Repo      string // name of the git repository or the source directory
+	File      string
+	Lines     int
+	Chars     int // visible characters used by the poster
+	GitCommit string
+	Date      string
+}
+
+func newTemplateData(code []sourceChar) templateData {
+	data := templateData{
+		File:  config.sourcePath,
+		Chars: len(code),
+		Date:  time.Now().Format("2006-01-02"),
+	}
+
+	dir := config.sourcePath
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+
+	data.Repo = filepath.Base(gitOutput(dir, "rev-parse", "--show-toplevel"))
+	if data.Repo == "." {
+		if abs, err := filepath.Abs(dir); err == nil {
+			data.Repo = filepath.Base(abs)
+		}
+	}
+	data.GitCommit = gitOutput(dir, "rev-parse", "--short", "HEAD")
+
+	files, err := sourceFiles()
+	if err == nil {
+		for _, file := range files {
+			if content, err := ioutil.ReadFile(file); err == nil {
+				data.Lines += bytes.Count(content, []byte("\n"))
+			}
+		}
+	}
+
+	return data
+}
+
+// gitOutput runs git in dir, empty if it fails, e.g. not a repository
+func gitOutput(dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// caption is a title, subtitle or footer drawn in the padding
+type caption struct {
+	textItem
+	size   int // font size
+	height int // line height in pixels
+}
+
+// captionLine is a caption before it is positioned
+type captionLine struct {
+	name string
+	text string
+	size int
+	font *ttf.Font
+}
+
+func newCaptionLine(name, text string, size int, data templateData) (*captionLine, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s", name)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, errors.Wrapf(err, "could not execute %s", name)
+	}
+
+	// captions are drawn on a single line
+	text = strings.TrimSpace(strings.Replace(buf.String(), "\n", " ", -1))
+	if text == "" {
+		return nil, nil
+	}
+
+	fontPath := config.captionFont
+	if fontPath == "" {
+		fontPath = config.fontPath
+	}
+
+	font, err := openFont(fontPath, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &captionLine{name, text, size, font}, nil
+}
+
+// layoutCaptions puts title and subtitle in the top padding and footer
+// in the bottom one, above the legend if there is one, legendY is where
+// the legend row goes
+func layoutCaptions(ctx *sdlContext, code []sourceChar, legend bool) (captions []caption, legendY int, err error) {
+	// the code frame and the border take the inner part of the padding
+	bottom := (config.padding.vertical - decorationPadding().vertical) * ctx.charHeight
+	legendY = ctx.winHeight - (bottom+ctx.charHeight)/2
+
+	if config.title == "" && config.subtitle == "" && config.footer == "" {
+		return nil, legendY, nil
+	}
+
+	data := newTemplateData(code)
+
+	var top, foot []*captionLine
+	for _, c := range []struct {
+		name  string
+		text  string
+		size  int
+		lines *[]*captionLine
+	}{
+		{"title", config.title, config.titleSize, &top},
+		{"subtitle", config.subtitle, config.subtitleSize, &top},
+		{"footer", config.footer, config.footerSize, &foot},
+	} {
+		// captions keep their size relative to the code
+		size := int(math.Round(float64(c.size) * ctx.scale))
+		line, err := newCaptionLine(c.name, c.text, size, data)
+		if err != nil {
+			return nil, 0, err
+		}
+		if line != nil {
+			*c.lines = append(*c.lines, line)
+		}
+	}
+
+	// lines of a block are separated by a third of the smaller line
+	blockHeight := func(heights []int) (total, gap int) {
+		min := 0
+		for _, h := range heights {
+			total += h
+			if min == 0 || h < min {
+				min = h
+			}
+		}
+		gap = min / 3
+		return total + gap*(len(heights)-1), gap
+	}
+
+	heightsOf := func(lines []*captionLine) []int {
+		var result []int
+		for _, line := range lines {
+			result = append(result, line.font.Height())
+		}
+		return result
+	}
+
+	footHeights := heightsOf(foot)
+	if legend && len(foot) > 0 {
+		footHeights = append(footHeights, ctx.charHeight)
+	}
+
+	topHeight, topGap := blockHeight(heightsOf(top))
+	footHeight, footGap := blockHeight(footHeights)
+
+	if need := maxInt(topHeight, footHeight); need > bottom {
+		rows := (need+ctx.charHeight-1)/ctx.charHeight + decorationPadding().vertical
+		return nil, 0, errors.Errorf("captions need %d rows of vertical padding, e.g. --padding %d,%d", rows, rows, config.padding.horizontal)
+	}
+
+	left := config.padding.horizontal * ctx.charWidth
+	right := ctx.winWidth - left
+
+	place := func(lines []*captionLine, y, gap int) error {
+		for _, line := range lines {
+			width, _, err := line.font.SizeUTF8(line.text)
+			if err != nil {
+				return errors.Wrapf(err, "could not get size of %s", line.name)
+			}
+			// too wide a caption starts at the left edge of the content and
+			// is cut at the right one whatever the alignment
+			x, clip := left, 0
+			if width > right-left {
+				log.Printf("%s is wider than the poster, clipped\n", line.name)
+				clip = right - left
+			} else {
+				switch config.captionAlign {
+				case "center":
+					x = (left + right - width) / 2
+				case "right":
+					x = right - width
+				}
+			}
+
+			height := line.font.Height()
+			captions = append(captions, caption{
+				textItem{line.text, sdl.Color(config.captionColor), x, y, line.font, clip},
+				line.size,
+				height,
+			})
+			y += height + gap
+		}
+
+		return nil
+	}
+
+	if err := place(top, (bottom-topHeight)/2, topGap); err != nil {
+		return nil, 0, err
+	}
+
+	footY := ctx.winHeight - bottom + (bottom-footHeight)/2
+	if err := place(foot, footY, footGap); err != nil {
+		return nil, 0, err
+	}
+	if legend && len(foot) > 0 {
+		legendY = footY + footHeight - ctx.charHeight
+	}
+
+	return captions, legendY, nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,100 @@
+// Package colorize decides the color of every character of a code
+// poster, colorizers are combined by Layer, Multiply and Mask
+package colorize
+
+import "image/color"
+
+// Cell is everything a colorizer knows about a character of the poster
+type Cell struct {
+	GridX, GridY   int     // in chars
+	PixelX, PixelY int     // center of the cell
+	Width, Height  int     // size of the cell in pixels
+	Angle          float64 // rotation of the glyph, clockwise in degrees
+	Char           byte
+	File           string
+	Line           int // starts from 1
+	Column         int // in bytes, starts from 1
+}
+
+// Colorizer decides the color of a cell, transparent means no opinion
+// so colorizers below it or code color show through
+type Colorizer interface {
+	Color(cell Cell) color.NRGBA
+}
+
+// ColorizerFunc adapts a function to Colorizer
+type ColorizerFunc func(cell Cell) color.NRGBA
+
+func (f ColorizerFunc) Color(cell Cell) color.NRGBA {
+	return f(cell)
+}
+
+// Layer composites top over bottom using alpha of top
+func Layer(bottom, top Colorizer) Colorizer {
+	return ColorizerFunc(func(cell Cell) color.NRGBA {
+		return Over(top.Color(cell), bottom.Color(cell))
+	})
+}
+
+// Multiply multiplies colors of bottom by top, alpha of top controls
+// the strength and alpha of bottom is kept
+func Multiply(bottom, top Colorizer) Colorizer {
+	return ColorizerFunc(func(cell Cell) color.NRGBA {
+		b, t := bottom.Color(cell), top.Color(cell)
+		a := float64(t.A) / 0xff
+
+		mul := func(x, y uint8) uint8 {
+			factor := 1 - a + a*float64(y)/0xff
+			return uint8(float64(x)*factor + 0.5)
+		}
+
+		return color.NRGBA{
+			R: mul(b.R, t.R),
+			G: mul(b.G, t.G),
+			B: mul(b.B, t.B),
+			A: b.A,
+		}
+	})
+}
+
+// Mask keeps bottom only where mask is opaque
+func Mask(bottom, mask Colorizer) Colorizer {
+	return ColorizerFunc(func(cell Cell) color.NRGBA {
+		b := bottom.Color(cell)
+		b.A = uint8(uint16(b.A) * uint16(mask.Color(cell).A) / 0xff)
+		return b
+	})
+}
+
+// Solid gives every cell the same color
+func Solid(c color.NRGBA) Colorizer {
+	return ColorizerFunc(func(Cell) color.NRGBA {
+		return c
+	})
+}
+
+// Over is the porter-duff over operator on non-premultiplied colors,
+// results of the blends stay in range so they are only rounded
+func Over(top, bottom color.NRGBA) color.NRGBA {
+	if top.A == 0xff || bottom.A == 0 {
+		return top
+	}
+	if top.A == 0 {
+		return bottom
+	}
+
+	ta := float64(top.A) / 0xff
+	ba := float64(bottom.A) / 0xff * (1 - ta)
+	a := ta + ba
+
+	mix := func(t, b uint8) uint8 {
+		return uint8((float64(t)*ta+float64(b)*ba)/a + 0.5)
+	}
+
+	return color.NRGBA{
+		R: mix(top.R, bottom.R),
+		G: mix(top.G, bottom.G),
+		B: mix(top.B, bottom.B),
+		A: uint8(a*0xff + 0.5),
+	}
+}
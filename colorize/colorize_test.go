@@ -0,0 +1,43 @@
+package colorize
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestCompose(t *testing.T) {
+	red := Solid(color.NRGBA{R: 0xff, A: 0xff})
+	halfBlue := Solid(color.NRGBA{B: 0xff, A: 0x80})
+	gray := Solid(color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0x80})
+	clear := Solid(color.NRGBA{})
+
+	tests := []struct {
+		name string
+		c    Colorizer
+		want color.NRGBA
+	}{
+		{"layer opaque top", Layer(halfBlue, red), color.NRGBA{R: 0xff, A: 0xff}},
+		{"layer transparent top", Layer(red, clear), color.NRGBA{R: 0xff, A: 0xff}},
+		{"layer half top", Layer(red, halfBlue), color.NRGBA{R: 0x7f, B: 0x80, A: 0xff}},
+		{"multiply half gray", Multiply(red, gray), color.NRGBA{R: 0xbf, A: 0xff}},
+		{"multiply transparent", Multiply(red, clear), color.NRGBA{R: 0xff, A: 0xff}},
+		{"mask half", Mask(red, halfBlue), color.NRGBA{R: 0xff, A: 0x80}},
+		{"mask clear", Mask(red, clear), color.NRGBA{R: 0xff}},
+	}
+
+	for _, test := range tests {
+		if got := test.c.Color(Cell{}); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestColorizerFunc(t *testing.T) {
+	byColumn := ColorizerFunc(func(cell Cell) color.NRGBA {
+		return color.NRGBA{R: uint8(cell.Column), A: 0xff}
+	})
+
+	if got := byColumn.Color(Cell{Column: 7}); got.R != 7 {
+		t.Errorf("got %v, want red 7", got)
+	}
+}
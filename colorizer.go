@@ -0,0 +1,285 @@
+package main
+
+import (
+	"go/scanner"
+	"go/token"
+	imgcolor "image/color"
+	"io/ioutil"
+	"strings"
+
+	"github.com/cj1128/codeposter/colorize"
+	"github.com/pkg/errors"
+)
+
+// Cell and Colorizer live in package colorize, so other programs can
+// write and combine colorizers without sdl, colorizers return
+// image/color colors which are converted to sdl.Color when drawn
+type (
+	Cell          = colorize.Cell
+	Colorizer     = colorize.Colorizer
+	ColorizerFunc = colorize.ColorizerFunc
+)
+
+// setChar fills in the character of a cell placed by a layout
+func setChar(c *Cell, char sourceChar) {
+	c.Char = char.char
+	c.File = char.file
+	c.Line = char.line
+	c.Column = char.col
+}
+
+// colorizerSpec is an entry of the colorizer stack, 'name[:mode]'
+type colorizerSpec struct {
+	name string
+	mode string
+}
+
+type colorizerSpecs []colorizerSpec
+
+var colorizerNames = []string{"image", "gradient", "syntax", "coverage", "blame", "pprof"}
+
+var colorizerModes = []string{"layer", "multiply", "mask"}
+
+func (s *colorizerSpecs) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		spec := colorizerSpec{name: part, mode: "layer"}
+		if i := strings.Index(part, ":"); i >= 0 {
+			spec.name, spec.mode = part[:i], part[i+1:]
+		}
+
+		if !stringIn(spec.name, colorizerNames) {
+			return errors.Errorf("unknown colorizer '%s', should be one of %s", spec.name, strings.Join(colorizerNames, ", "))
+		}
+		if !stringIn(spec.mode, colorizerModes) {
+			return errors.Errorf("unknown colorizer mode '%s', should be one of %s", spec.mode, strings.Join(colorizerModes, ", "))
+		}
+
+		*s = append(*s, spec)
+	}
+
+	return nil
+}
+
+func (s *colorizerSpecs) String() string {
+	parts := make([]string, len(*s))
+	for i, spec := range *s {
+		parts[i] = spec.name + ":" + spec.mode
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (s *colorizerSpecs) IsCumulative() bool {
+	return true
+}
+
+func stringIn(s string, list []string) bool {
+	for _, item := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
+// buildColorizer composes the colorizer stack from config on top of code
+// color, without --colorizer the image is at the bottom and data
+// colorizers with flags set are layered on it
+func buildColorizer(src *sourceImage, ctx *sdlContext) (Colorizer, []legendEntry, error) {
+	specs := config.colorizers
+	if len(specs) == 0 {
+		specs = colorizerSpecs{{"image", "layer"}}
+		if config.coverProfile != "" {
+			specs = append(specs, colorizerSpec{"coverage", "layer"})
+		}
+		if config.blame != "" {
+			specs = append(specs, colorizerSpec{"blame", "layer"})
+		}
+		if config.pprofPath != "" {
+			specs = append(specs, colorizerSpec{"pprof", "layer"})
+		}
+	}
+
+	var stack Colorizer
+	var legend []legendEntry
+
+	for _, spec := range specs {
+		var c Colorizer
+
+		switch spec.name {
+		case "image":
+			c = ColorizerFunc(func(cell Cell) imgcolor.NRGBA {
+				return imgcolor.NRGBA(getColor(src, ctx.winWidth, ctx.winHeight, cell.PixelX, cell.PixelY))
+			})
+
+		case "gradient":
+			if len(config.gradient) == 0 {
+				return nil, nil, errors.New("gradient colorizer needs --gradient")
+			}
+			c = ColorizerFunc(func(cell Cell) imgcolor.NRGBA {
+				x := cell.PixelX - config.padding.horizontal*ctx.charWidth
+				y := cell.PixelY - config.padding.vertical*ctx.charHeight
+				return imgcolor.NRGBA(gradientAt(config.gradient, gradientPosition(config.gradientType, config.angle, ctx.contentWidth, ctx.contentHeight, x, y)))
+			})
+
+		case "syntax":
+			syntax, err := readSyntax()
+			if err != nil {
+				return nil, nil, err
+			}
+			c = syntax
+
+		case "coverage":
+			if config.coverProfile == "" {
+				return nil, nil, errors.New("coverage colorizer needs --coverprofile")
+			}
+			cover, err := readCoverProfile(config.coverProfile)
+			if err != nil {
+				return nil, nil, err
+			}
+			c = cover
+
+		case "blame":
+			// the blame colorizer alone colors by age
+			mode := config.blame
+			if mode == "" {
+				mode = "age"
+			}
+			blameInfo, err := readBlame(mode)
+			if err != nil {
+				return nil, nil, err
+			}
+			legend = blameInfo.legend()
+			c = blameInfo
+
+		case "pprof":
+			if config.pprofPath == "" {
+				return nil, nil, errors.New("pprof colorizer needs --pprof")
+			}
+			hot, err := readPprof(config.pprofPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			c = hot
+		}
+
+		switch {
+		case stack == nil:
+			stack = c
+		case spec.mode == "multiply":
+			stack = colorize.Multiply(stack, c)
+		case spec.mode == "mask":
+			stack = colorize.Mask(stack, c)
+		default:
+			stack = colorize.Layer(stack, c)
+		}
+	}
+
+	return colorize.Layer(colorize.Solid(imgcolor.NRGBA(config.codeColor)), stack), legend, nil
+}
+
+// token classes of the syntax colorizer
+const (
+	syntaxNone = iota
+	syntaxKeyword
+	syntaxString
+	syntaxNumber
+	syntaxComment
+)
+
+var syntaxColors = map[int]imgcolor.NRGBA{
+	syntaxKeyword: {R: 0xd7, G: 0x3a, B: 0x49, A: 0xff},
+	syntaxString:  {R: 0x03, G: 0x2f, B: 0x62, A: 0xff},
+	syntaxNumber:  {R: 0x00, G: 0x5c, B: 0xc5, A: 0xff},
+	syntaxComment: {R: 0x6a, G: 0x73, B: 0x7d, A: 0xff},
+}
+
+// syntax colors keywords, literals and comments found by the go scanner,
+// which works well enough for most c-like languages
+type syntax struct {
+	classes   map[string][]uint8 // token class of each byte
+	lineStart map[string][]int   // offset of each line
+}
+
+func readSyntax() (*syntax, error) {
+	files, err := sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &syntax{
+		classes:   make(map[string][]uint8),
+		lineStart: make(map[string][]int),
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read source code")
+		}
+
+		classes := make([]uint8, len(content))
+		lineStart := []int{0}
+		for i, b := range content {
+			if b == '\n' {
+				lineStart = append(lineStart, i+1)
+			}
+		}
+
+		fset := token.NewFileSet()
+		var s scanner.Scanner
+		s.Init(fset.AddFile(file, -1, len(content)), content, func(token.Position, string) {}, scanner.ScanComments)
+
+		for {
+			pos, tok, lit := s.Scan()
+			if tok == token.EOF {
+				break
+			}
+
+			class := syntaxNone
+			switch {
+			case tok.IsKeyword():
+				class = syntaxKeyword
+			case tok == token.STRING || tok == token.CHAR:
+				class = syntaxString
+			case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+				class = syntaxNumber
+			case tok == token.COMMENT:
+				class = syntaxComment
+			}
+			if class == syntaxNone {
+				continue
+			}
+
+			start := fset.Position(pos).Offset
+			for i := start; i < start+len(lit) && i < len(classes); i++ {
+				classes[i] = uint8(class)
+			}
+		}
+
+		result.classes[file] = classes
+		result.lineStart[file] = lineStart
+	}
+
+	return result, nil
+}
+
+func (s *syntax) Color(cell Cell) imgcolor.NRGBA {
+	lineStart := s.lineStart[cell.File]
+	if cell.Line < 1 || cell.Line > len(lineStart) {
+		return imgcolor.NRGBA{}
+	}
+
+	offset := lineStart[cell.Line-1] + cell.Column - 1
+	classes := s.classes[cell.File]
+	if offset >= len(classes) {
+		return imgcolor.NRGBA{}
+	}
+
+	return syntaxColors[int(classes[offset])]
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	imgcolor "image/color"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type coverBlock struct {
+	startLine, startCol int
+	endLine, endCol     int
+	count               int
+}
+
+func (b *coverBlock) contains(line, col int) bool {
+	if line < b.startLine || line > b.endLine {
+		return false
+	}
+	if line == b.startLine && col < b.startCol {
+		return false
+	}
+	if line == b.endLine && col >= b.endCol {
+		return false
+	}
+	return true
+}
+
+// coverage holds blocks of a go test -coverprofile file indexed by
+// source file and line
+type coverage struct {
+	files   *fileMatcher
+	byLines map[string]map[int][]*coverBlock
+}
+
+// readCoverProfile parses lines like 'pkg/file.go:10.2,12.16 2 1'
+func readCoverProfile(profilePath string) (*coverage, error) {
+	files, err := sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(profilePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open cover profile")
+	}
+	defer f.Close()
+
+	result := &coverage{
+		files:   newFileMatcher(files),
+		byLines: make(map[string]map[int][]*coverBlock),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "mode:") {
+			continue
+		}
+
+		file, block, err := parseCoverLine(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid cover profile line %d", lineNo)
+		}
+
+		source := result.files.match(file)
+		if source == "" {
+			continue
+		}
+
+		lines := result.byLines[source]
+		if lines == nil {
+			lines = make(map[int][]*coverBlock)
+			result.byLines[source] = lines
+		}
+		for l := block.startLine; l <= block.endLine; l++ {
+			lines[l] = append(lines[l], block)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read cover profile")
+	}
+
+	if len(result.byLines) == 0 {
+		return nil, errors.New("cover profile has no blocks for the source code")
+	}
+
+	return result, nil
+}
+
+func parseCoverLine(line string) (string, *coverBlock, error) {
+	colon := strings.LastIndex(line, ":")
+	if colon < 0 {
+		return "", nil, errors.New("missing ':'")
+	}
+
+	var block coverBlock
+	var numStmt int
+	fields := strings.FieldsFunc(line[colon+1:], func(r rune) bool {
+		return r == '.' || r == ',' || r == ' '
+	})
+	if len(fields) != 6 {
+		return "", nil, errors.New("should be 'file:line.col,line.col statements count'")
+	}
+
+	targets := []*int{&block.startLine, &block.startCol, &block.endLine, &block.endCol, &numStmt, &block.count}
+	for i, field := range fields {
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "could not parse string to integer")
+		}
+		*targets[i] = v
+	}
+
+	return line[:colon], &block, nil
+}
+
+// Color returns coverage color of the character, its alpha comes from
+// coverage blend, characters outside of any block are transparent
+func (c *coverage) Color(cell Cell) imgcolor.NRGBA {
+	found, covered := false, false
+
+	for _, block := range c.byLines[cell.File][cell.Line] {
+		if block.contains(cell.Line, cell.Column) {
+			found = true
+			covered = covered || block.count > 0
+		}
+	}
+
+	if !found {
+		return imgcolor.NRGBA{}
+	}
+
+	result := imgcolor.NRGBA(config.uncoveredColor)
+	if covered {
+		result = imgcolor.NRGBA(config.coveredColor)
+	}
+	result.A = clamp8(float64(result.A) * config.coverageBlend)
+
+	return result
+}
+
+// fileMatcher maps file names found in profiles, usually import paths
+// or paths on another machine, to source files
+type fileMatcher struct {
+	files   [][]string // path segments of each source file
+	paths   []string
+	exact   map[string]string // absolute path or import path to file
+	modules []string          // module paths of the sources
+	cache   map[string]string
+}
+
+var goModReg = regexp.MustCompile(`(?m)^module\s+"?([^"\s]+)"?`)
+
+func newFileMatcher(files []string) *fileMatcher {
+	m := &fileMatcher{
+		exact: make(map[string]string),
+		cache: make(map[string]string),
+	}
+
+	modules := make(map[string]goModule) // by directory
+	for _, file := range files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			abs = file
+		}
+		m.files = append(m.files, strings.Split(filepath.ToSlash(abs), "/"))
+		m.paths = append(m.paths, file)
+		m.exact[filepath.ToSlash(abs)] = file
+
+		if mod := findGoModule(filepath.Dir(abs), modules); mod.path != "" {
+			if rel, err := filepath.Rel(mod.dir, abs); err == nil {
+				m.exact[mod.path+"/"+filepath.ToSlash(rel)] = file
+			}
+			if !stringIn(mod.path, m.modules) {
+				m.modules = append(m.modules, mod.path)
+			}
+		}
+	}
+
+	return m
+}
+
+// goModule is the module a source file belongs to
+type goModule struct {
+	path string
+	dir  string // where go.mod is
+}
+
+// findGoModule looks for go.mod in dir and its parents, found is a
+// cache by directory
+func findGoModule(dir string, found map[string]goModule) goModule {
+	if mod, ok := found[dir]; ok {
+		return mod
+	}
+
+	var result goModule
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+		if match := goModReg.FindSubmatch(content); match != nil {
+			result = goModule{string(match[1]), dir}
+		}
+	} else if parent := filepath.Dir(dir); parent != dir {
+		result = findGoModule(parent, found)
+	}
+
+	found[dir] = result
+
+	return result
+}
+
+// match returns the source file a profile name refers to, or "" when
+// there is none or several match equally well
+func (m *fileMatcher) match(name string) string {
+	if result, ok := m.cache[name]; ok {
+		return result
+	}
+
+	result := m.lookup(filepath.ToSlash(name))
+	m.cache[name] = result
+
+	return result
+}
+
+func (m *fileMatcher) lookup(name string) string {
+	if result, ok := m.exact[name]; ok {
+		return result
+	}
+
+	// import paths of the modules of the sources are resolved exactly,
+	// others may be a dependency, like 'fmt/print.go', or the sources
+	// in a gopath
+	abs := path.IsAbs(name) || len(name) > 2 && name[1] == ':' && name[2] == '/'
+	if !abs && len(m.modules) > 0 {
+		return ""
+	}
+
+	// otherwise match the trailing path, the base name alone is not
+	// enough when the name has a directory
+	segments := strings.Split(name, "/")
+	result, best, tie := "", 0, false
+	if len(segments) > 1 {
+		best = 1
+	}
+
+	for i, file := range m.files {
+		n := 0
+		for n < len(file) && n < len(segments) &&
+			file[len(file)-1-n] == segments[len(segments)-1-n] {
+			n++
+		}
+
+		switch {
+		case n > best:
+			result, best, tie = m.paths[i], n, false
+		case n == best && result != "":
+			tie = true
+		}
+	}
+
+	if tie {
+		return ""
+	}
+
+	return result
+}
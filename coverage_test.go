@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles creates files with empty content under dir
+func writeFiles(t *testing.T, dir string, names ...string) []string {
+	var result []string
+	for _, name := range names {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+func TestFileMatcherModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codeposter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/poster\n\ngo 1.14\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := writeFiles(t, dir, "main.go", "print.go", "util/util.go")
+	m := newFileMatcher(files)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com/poster/print.go", files[1]},
+		{"example.com/poster/util/util.go", files[2]},
+		{filepath.ToSlash(files[0]), files[0]},
+		{"/build/machine/poster/util/util.go", files[2]},
+		{"example.com/poster/missing.go", ""},
+		{"fmt/print.go", ""},
+		{"github.com/dep/util/util.go", ""},
+		{"/usr/local/go/src/fmt/print.go", ""},
+	}
+
+	for _, test := range tests {
+		if got := m.match(test.name); got != test.want {
+			t.Errorf("match(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFileMatcherGopath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codeposter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := writeFiles(t, dir, "src/github.com/cj1128/codeposter/main.go", "src/github.com/cj1128/codeposter/a/util.go", "src/github.com/cj1128/codeposter/b/util.go")
+	m := newFileMatcher(files)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"github.com/cj1128/codeposter/main.go", files[0]},
+		{"codeposter/a/util.go", files[1]},
+		{"main.go", files[0]},
+		{"fmt/main.go", ""},
+		{"util.go", ""},
+		{"github.com/dep/util.go", ""},
+	}
+
+	for _, test := range tests {
+		if got := m.match(test.name); got != test.want {
+			t.Errorf("match(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
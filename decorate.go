@@ -0,0 +1,229 @@
+package main
+
+import (
+	"image"
+	imgcolor "image/color"
+	"image/draw"
+	"log"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// decorations are drawn around the content area, from inside out: the
+// code frame, the border, then the drop shadow under both
+type decorations struct {
+	content image.Rectangle // code grid in pixels
+	frame   image.Rectangle // content and code frame
+	box     image.Rectangle // frame and border, casts the shadow
+	radius  float64         // corner radius of box in pixels
+	shadow  image.Rectangle // box moved by the shadow offset
+	blur    float64
+}
+
+// decorationPadding is how many characters of the padding are taken
+// by the code frame and the border
+func decorationPadding() padding {
+	result := config.codeFrame
+	if config.border != "none" {
+		result.horizontal += config.borderWidth.horizontal
+		result.vertical += config.borderWidth.vertical
+	}
+
+	return result
+}
+
+func checkDecorations() error {
+	need := decorationPadding()
+	if need.horizontal > config.padding.horizontal || need.vertical > config.padding.vertical {
+		return errors.Errorf("code frame and border need a padding of at least %d,%d", need.vertical, need.horizontal)
+	}
+
+	if config.vignette < 0 || config.vignette > 1 {
+		return errors.New("vignette should be between 0 and 1")
+	}
+
+	if config.format == "html" && (need != padding{} || config.shadow != padding{} || config.vignette > 0) {
+		log.Println("decorations are not drawn in html")
+	}
+
+	return nil
+}
+
+func newDecorations(ctx *sdlContext) *decorations {
+	cw, ch := ctx.charWidth, ctx.charHeight
+	expand := func(r image.Rectangle, p padding) image.Rectangle {
+		return image.Rect(r.Min.X-p.horizontal*cw, r.Min.Y-p.vertical*ch, r.Max.X+p.horizontal*cw, r.Max.Y+p.vertical*ch)
+	}
+
+	d := &decorations{}
+	d.content = image.Rect(0, 0, ctx.contentWidth, ctx.contentHeight).
+		Add(image.Pt(config.padding.horizontal*cw, config.padding.vertical*ch))
+	d.frame = expand(d.content, config.codeFrame)
+	d.box = d.frame
+	if config.border != "none" {
+		d.box = expand(d.frame, config.borderWidth)
+	}
+	d.radius = float64(config.cornerRadius * cw)
+	d.shadow = d.box.Add(image.Pt(config.shadow.horizontal*cw, config.shadow.vertical*ch))
+	d.blur = float64(ch)
+
+	return d
+}
+
+// drawShadow is drawn right after the background, only around the box
+func (d *decorations) drawShadow(dst *image.RGBA, origin image.Point) {
+	if config.shadow == (padding{}) {
+		return
+	}
+
+	area := d.shadow.Inset(-int(math.Ceil(d.blur))).Sub(origin).Intersect(dst.Bounds())
+	if area.Empty() {
+		return
+	}
+
+	// a blurred rectangle is separable, coverage of each axis is the
+	// part of the blur window inside the rectangle
+	coverage := func(p, min, max float64) float64 {
+		return math.Max(0, math.Min(p+d.blur, max)-math.Max(p-d.blur, min)) / (2 * d.blur)
+	}
+
+	xs := make([]float64, area.Dx())
+	for x := range xs {
+		xs[x] = coverage(float64(area.Min.X+x+origin.X)+0.5, float64(d.shadow.Min.X), float64(d.shadow.Max.X))
+	}
+
+	c := imgcolor.NRGBA(config.shadowColor)
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		cy := coverage(float64(y+origin.Y)+0.5, float64(d.shadow.Min.Y), float64(d.shadow.Max.Y))
+		for x := area.Min.X; x < area.Max.X; x++ {
+			cov := cy * xs[x-area.Min.X]
+			if cov == 0 {
+				continue
+			}
+
+			cov *= 1 - roundRectCoverage(float64(x+origin.X)+0.5, float64(y+origin.Y)+0.5, d.box, d.radius)
+			if cov > 0 {
+				blendPixel(dst, dst.PixOffset(x, y), c, cov)
+			}
+		}
+	}
+}
+
+// drawBorder draws a solid border, or two lines of a third of its
+// width for a double one
+func (d *decorations) drawBorder(dst *image.RGBA, origin image.Point) {
+	c := imgcolor.NRGBA(config.borderColor)
+
+	inset := func(r image.Rectangle, radius float64, part int) (image.Rectangle, float64) {
+		x := (d.frame.Min.X - d.box.Min.X) * part / 3
+		y := (d.frame.Min.Y - d.box.Min.Y) * part / 3
+		return image.Rect(r.Min.X+x, r.Min.Y+y, r.Max.X-x, r.Max.Y-y), math.Max(radius-float64(minInt(x, y)), 0)
+	}
+
+	switch config.border {
+	case "solid":
+		inner, innerRadius := inset(d.box, d.radius, 3)
+		paintRoundRect(dst, origin, d.box, d.radius, inner, innerRadius, c)
+	case "double":
+		inner, innerRadius := inset(d.box, d.radius, 1)
+		paintRoundRect(dst, origin, d.box, d.radius, inner, innerRadius, c)
+
+		outer, outerRadius := inset(d.box, d.radius, 2)
+		inner, innerRadius = inset(d.box, d.radius, 3)
+		paintRoundRect(dst, origin, outer, outerRadius, inner, innerRadius, c)
+	}
+}
+
+// drawVignette darkens the poster towards its corners
+func drawVignette(dst *image.RGBA, origin image.Point, width, height int) {
+	if config.vignette == 0 {
+		return
+	}
+
+	bounds := dst.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		dy := (float64(y+origin.Y)+0.5)/float64(height)*2 - 1
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			dx := (float64(x+origin.X)+0.5)/float64(width)*2 - 1
+
+			// 0 in the center, 1 at the corners
+			dist := math.Min((dx*dx+dy*dy)/2, 1)
+			factor := 1 - config.vignette*dist*dist
+
+			i := dst.PixOffset(x, y)
+			for k := 0; k < 3; k++ {
+				dst.Pix[i+k] = uint8(float64(dst.Pix[i+k]) * factor)
+			}
+		}
+	}
+}
+
+// paintRoundRect paints the rounded rectangle outer minus the rounded
+// rectangle inner, an empty inner fills outer, rectangles are in poster
+// coordinates and origin is where dst starts
+func paintRoundRect(dst *image.RGBA, origin image.Point, outer image.Rectangle, outerRadius float64, inner image.Rectangle, innerRadius float64, c imgcolor.NRGBA) {
+	area := outer.Sub(origin).Intersect(dst.Bounds())
+	if area.Empty() {
+		return
+	}
+
+	// away from the corners and edges a pixel is fully covered, or not at all
+	var skip image.Rectangle
+	if inner.Empty() {
+		skip = outer.Inset(int(math.Ceil(outerRadius)) + 1).Sub(origin).Intersect(area)
+		draw.Draw(dst, skip, image.NewUniform(c), image.Point{}, draw.Over)
+	} else {
+		skip = inner.Inset(int(math.Ceil(innerRadius)) + 1).Sub(origin).Intersect(area)
+	}
+
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			if y >= skip.Min.Y && y < skip.Max.Y && x == skip.Min.X {
+				x = skip.Max.X - 1
+				continue
+			}
+
+			px, py := float64(x+origin.X)+0.5, float64(y+origin.Y)+0.5
+			cov := roundRectCoverage(px, py, outer, outerRadius)
+			if !inner.Empty() {
+				cov *= 1 - roundRectCoverage(px, py, inner, innerRadius)
+			}
+
+			if cov > 0 {
+				blendPixel(dst, dst.PixOffset(x, y), c, cov)
+			}
+		}
+	}
+}
+
+// roundRectCoverage is how much of the pixel at (x, y) is inside the
+// rounded rectangle, by its signed distance
+func roundRectCoverage(x, y float64, r image.Rectangle, radius float64) float64 {
+	halfW, halfH := float64(r.Dx())/2, float64(r.Dy())/2
+	radius = math.Min(radius, math.Min(halfW, halfH))
+
+	qx := math.Abs(x-float64(r.Min.X)-halfW) - halfW + radius
+	qy := math.Abs(y-float64(r.Min.Y)-halfH) - halfH + radius
+	dist := math.Hypot(math.Max(qx, 0), math.Max(qy, 0)) + math.Min(math.Max(qx, qy), 0) - radius
+
+	return math.Max(0, math.Min(1, 0.5-dist))
+}
+
+// blendPixel composites c with coverage over the premultiplied pixel at i
+func blendPixel(dst *image.RGBA, i int, c imgcolor.NRGBA, coverage float64) {
+	alpha := float64(c.A) / 0xff
+	keep := 1 - alpha*coverage
+
+	src := [4]float64{float64(c.R) * alpha, float64(c.G) * alpha, float64(c.B) * alpha, float64(c.A)}
+	for k := 0; k < 4; k++ {
+		dst.Pix[i+k] = clamp8(src[k]*coverage + float64(dst.Pix[i+k])*keep)
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
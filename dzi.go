@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+const dziTileSize = 256
+
+// writeDZI writes a deep zoom image: 'x.dzi', tiles in 'x_files/<level>/<col>_<row>.png'
+// and an offline viewer 'x.dzi.html'. Only the highest level is rendered, tile
+// by tile, each lower level is downsampled from four tiles of the level above
+// so no pixel buffer of the whole poster is allocated.
+func writeDZI(outputName string, ctx *sdlContext, cells []Cell, colors []sdl.Color, texts []textItem) error {
+	renderer, err := newRegionRenderer(ctx, cells, colors, texts)
+	if err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(outputName, ".dzi")
+	tilesDir := base + "_files"
+	width, height := ctx.winWidth, ctx.winHeight
+
+	maxLevel := 0
+	for (1<<uint(maxLevel)) < width || (1<<uint(maxLevel)) < height {
+		maxLevel++
+	}
+
+	levelSize := func(level int) (int, int) {
+		shift := uint(maxLevel - level)
+		return (width + 1<<shift - 1) >> shift, (height + 1<<shift - 1) >> shift
+	}
+
+	tilePath := func(level, col, row int) string {
+		return filepath.Join(tilesDir, fmt.Sprint(level), fmt.Sprintf("%d_%d.png", col, row))
+	}
+
+	for level := maxLevel; level >= 0; level-- {
+		if err := os.MkdirAll(filepath.Join(tilesDir, fmt.Sprint(level)), 0755); err != nil {
+			return errors.Wrap(err, "could not create tiles directory")
+		}
+
+		w, h := levelSize(level)
+		cols := (w + dziTileSize - 1) / dziTileSize
+		rows := (h + dziTileSize - 1) / dziTileSize
+
+		for row := 0; row < rows; row++ {
+			for col := 0; col < cols; col++ {
+				rect := image.Rect(col*dziTileSize, row*dziTileSize, (col+1)*dziTileSize, (row+1)*dziTileSize).
+					Intersect(image.Rect(0, 0, w, h))
+
+				var tile *image.RGBA
+				if level == maxLevel {
+					tile = renderer.render(rect)
+				} else {
+					tile, err = mergeTiles(rect, func(c, r int) string {
+						return tilePath(level+1, c, r)
+					}, col, row)
+					if err != nil {
+						return err
+					}
+				}
+
+				if err := savePNG(tilePath(level, col, row), tile); err != nil {
+					return err
+				}
+			}
+		}
+
+		log.Printf("dzi level %d done (%dx%d)\n", level, w, h)
+	}
+
+	descriptor := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="png" Overlap="0" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`, dziTileSize, width, height)
+
+	if err := ioutil.WriteFile(outputName, []byte(descriptor), 0644); err != nil {
+		return errors.Wrap(err, "could not write dzi descriptor")
+	}
+
+	viewer, err := os.Create(outputName + ".html")
+	if err != nil {
+		return errors.Wrap(err, "could not create dzi viewer")
+	}
+	defer viewer.Close()
+
+	err = dziViewerTemplate.Execute(viewer, map[string]interface{}{
+		"Title":    config.sourcePath,
+		"Width":    width,
+		"Height":   height,
+		"TileSize": dziTileSize,
+		"MaxLevel": maxLevel,
+		"TilesDir": filepath.Base(tilesDir),
+		"BgColor":  cssColor(sdl.Color(config.bgColor)),
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not write dzi viewer")
+	}
+
+	return nil
+}
+
+// mergeTiles builds tile (col, row) of a level from the four tiles
+// covering the same area in the level above
+func mergeTiles(rect image.Rectangle, childPath func(col, row int) string, col, row int) (*image.RGBA, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	half := dziTileSize / 2
+
+	for dy := 0; dy < 2; dy++ {
+		for dx := 0; dx < 2; dx++ {
+			path := childPath(col*2+dx, row*2+dy)
+			if !fileExists(path) {
+				continue
+			}
+
+			child, err := loadPNG(path)
+			if err != nil {
+				return nil, err
+			}
+
+			halveInto(dst, child, image.Pt(dx*half, dy*half))
+		}
+	}
+
+	return dst, nil
+}
+
+// halveInto downsamples src by 2 with a box filter and draws it at offset
+func halveInto(dst *image.RGBA, src image.Image, offset image.Point) {
+	bounds := src.Bounds()
+	w, h := (bounds.Dx()+1)/2, (bounds.Dy()+1)/2
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]uint32
+			n := uint32(0)
+
+			for sy := y * 2; sy < y*2+2 && sy < bounds.Dy(); sy++ {
+				for sx := x * 2; sx < x*2+2 && sx < bounds.Dx(); sx++ {
+					r, g, b, a := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					sum[0] += r
+					sum[1] += g
+					sum[2] += b
+					sum[3] += a
+					n++
+				}
+			}
+
+			p := image.Pt(x, y).Add(offset)
+			if !p.In(dst.Bounds()) {
+				continue
+			}
+
+			i := dst.PixOffset(p.X, p.Y)
+			for ch := 0; ch < 4; ch++ {
+				dst.Pix[i+ch] = uint8(sum[ch] / n >> 8)
+			}
+		}
+	}
+}
+
+func savePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "could not create png")
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		return errors.Wrap(err, "could not encode png")
+	}
+
+	return nil
+}
+
+func loadPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open png")
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode png")
+	}
+
+	return img, nil
+}
+
+var dziViewerTemplate = template.Must(template.New("viewer").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+html, body { margin: 0; height: 100%; overflow: hidden; background: #222; }
+canvas { display: block; cursor: grab; }
+#info { position: fixed; left: 8px; bottom: 8px; color: #aaa; font: 12px sans-serif; }
+</style>
+</head>
+<body>
+<canvas id="view"></canvas>
+<div id="info">drag to pan, scroll to zoom, double click to reset</div>
+<script>
+(function() {
+  var width = {{.Width}}, height = {{.Height}}, tileSize = {{.TileSize}}, maxLevel = {{.MaxLevel}};
+  var tilesDir = {{.TilesDir}}, bgColor = {{.BgColor}};
+
+  var canvas = document.getElementById("view");
+  var g = canvas.getContext("2d");
+  var cache = {};
+  var scale, offsetX, offsetY; // screen = poster * scale + offset
+
+  function reset() {
+    scale = Math.min(canvas.width / width, canvas.height / height) * 0.95;
+    offsetX = (canvas.width - width * scale) / 2;
+    offsetY = (canvas.height - height * scale) / 2;
+  }
+
+  function resize() {
+    canvas.width = window.innerWidth;
+    canvas.height = window.innerHeight;
+  }
+
+  function tile(level, col, row) {
+    var key = level + "/" + col + "_" + row;
+    var img = cache[key];
+    if (!img) {
+      img = cache[key] = new Image();
+      img.onload = draw;
+      img.src = tilesDir + "/" + key + ".png";
+    }
+    return img.complete && img.naturalWidth ? img : null;
+  }
+
+  function drawLevel(level, load) {
+    var factor = Math.pow(2, maxLevel - level); // poster pixels per level pixel
+    var size = tileSize * factor * scale;
+    var levelWidth = Math.ceil(width / factor), levelHeight = Math.ceil(height / factor);
+    var cols = Math.ceil(levelWidth / tileSize), rows = Math.ceil(levelHeight / tileSize);
+    var minCol = Math.max(0, Math.floor(-offsetX / size)), maxCol = Math.min(cols - 1, Math.floor((canvas.width - offsetX) / size));
+    var minRow = Math.max(0, Math.floor(-offsetY / size)), maxRow = Math.min(rows - 1, Math.floor((canvas.height - offsetY) / size));
+
+    for (var row = minRow; row <= maxRow; row++) {
+      for (var col = minCol; col <= maxCol; col++) {
+        var img = load || cache[level + "/" + col + "_" + row] ? tile(level, col, row) : null;
+        if (img) {
+          g.drawImage(img, offsetX + col * size, offsetY + row * size, img.naturalWidth * factor * scale, img.naturalHeight * factor * scale);
+        }
+      }
+    }
+  }
+
+  function draw() {
+    g.fillStyle = "#222";
+    g.fillRect(0, 0, canvas.width, canvas.height);
+    g.fillStyle = bgColor;
+    g.fillRect(offsetX, offsetY, width * scale, height * scale);
+
+    var level = Math.max(0, Math.min(maxLevel, maxLevel + Math.ceil(Math.log2(scale))));
+    // coarser levels already loaded fill the gaps while tiles are loading
+    for (var l = Math.max(0, level - 3); l < level; l++) {
+      drawLevel(l, false);
+    }
+    drawLevel(level, true);
+  }
+
+  var dragging = null;
+  canvas.addEventListener("mousedown", function(e) {
+    dragging = {x: e.clientX, y: e.clientY};
+    canvas.style.cursor = "grabbing";
+  });
+  window.addEventListener("mouseup", function() {
+    dragging = null;
+    canvas.style.cursor = "grab";
+  });
+  window.addEventListener("mousemove", function(e) {
+    if (!dragging) {
+      return;
+    }
+    offsetX += e.clientX - dragging.x;
+    offsetY += e.clientY - dragging.y;
+    dragging = {x: e.clientX, y: e.clientY};
+    draw();
+  });
+  canvas.addEventListener("wheel", function(e) {
+    e.preventDefault();
+    var factor = Math.pow(1.0015, -e.deltaY);
+    offsetX = e.clientX - (e.clientX - offsetX) * factor;
+    offsetY = e.clientY - (e.clientY - offsetY) * factor;
+    scale *= factor;
+    draw();
+  }, {passive: false});
+  canvas.addEventListener("dblclick", function() {
+    reset();
+    draw();
+  });
+  window.addEventListener("resize", function() {
+    resize();
+    draw();
+  });
+
+  resize();
+  reset();
+  draw();
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+type htmlPoster struct {
+	Title      string
+	FontFace   template.CSS
+	FontSize   int
+	Background template.CSS
+	PadX       int // in pixels
+	PadY       int // in pixels
+	CharWidth  int
+	CharHeight int
+	Rows       []string
+	Palette    []string
+	Colors     []int // index of palette by cell
+	FileIndex  []int // index of files by cell
+	Lines      []int
+	Columns    []int
+	Files      []string
+	Sources    []string
+	Legend     []htmlLegend
+	Captions   []htmlCaption
+}
+
+type htmlLegend struct {
+	Text  string
+	Color template.CSS
+}
+
+type htmlCaption struct {
+	Text   string
+	Color  template.CSS
+	Font   string
+	Size   int
+	Height int
+	X, Y   int // in pixels
+	Width  int // clips the caption, 0 for no clipping
+}
+
+func cssColor(c sdl.Color) string {
+	return fmt.Sprintf("rgba(%d,%d,%d,%.3f)", c.R, c.G, c.B, float64(c.A)/0xff)
+}
+
+// writeHTML writes a self-contained page, font and source code are
+// embedded so it works offline
+func writeHTML(outputName string, ctx *sdlContext, cells []Cell, colors []sdl.Color, legend []legendEntry, captions []caption) error {
+	fontFace, err := cssFontFace("codeposter", config.fontPath)
+	if err != nil {
+		return err
+	}
+
+	captionFont := "codeposter"
+	if config.captionFont != "" && len(captions) > 0 {
+		captionFont = "codeposter-caption"
+		face, err := cssFontFace(captionFont, config.captionFont)
+		if err != nil {
+			return err
+		}
+		fontFace += "\n" + face
+	}
+
+	data := htmlPoster{
+		Title:      config.sourcePath,
+		FontFace:   template.CSS(fontFace),
+		FontSize:   config.fontSize,
+		Background: template.CSS(cssColor(sdl.Color(config.bgColor))),
+		PadX:       config.padding.horizontal * ctx.charWidth,
+		PadY:       config.padding.vertical * ctx.charHeight,
+		CharWidth:  ctx.charWidth,
+		CharHeight: ctx.charHeight,
+		Colors:     make([]int, len(cells)),
+		FileIndex:  make([]int, len(cells)),
+		Lines:      make([]int, len(cells)),
+		Columns:    make([]int, len(cells)),
+	}
+
+	paletteIndex := make(map[sdl.Color]int)
+	fileIndex := make(map[string]int)
+	row := make([]byte, 0, config.width)
+
+	for i, cell := range cells {
+		c := colors[i]
+		if _, ok := paletteIndex[c]; !ok {
+			paletteIndex[c] = len(data.Palette)
+			data.Palette = append(data.Palette, cssColor(c))
+		}
+
+		if _, ok := fileIndex[cell.File]; !ok {
+			source, err := ioutil.ReadFile(cell.File)
+			if err != nil {
+				return errors.Wrap(err, "could not read source code")
+			}
+			fileIndex[cell.File] = len(data.Files)
+			data.Files = append(data.Files, cell.File)
+			data.Sources = append(data.Sources, string(source))
+		}
+
+		data.Colors[i] = paletteIndex[c]
+		data.FileIndex[i] = fileIndex[cell.File]
+		data.Lines[i] = cell.Line
+		data.Columns[i] = cell.Column
+
+		row = append(row, cell.Char)
+		if len(row) == config.width {
+			data.Rows = append(data.Rows, string(row))
+			row = row[:0]
+		}
+	}
+
+	for _, entry := range legend {
+		data.Legend = append(data.Legend, htmlLegend{entry.text, template.CSS(cssColor(entry.color))})
+	}
+
+	for _, c := range captions {
+		data.Captions = append(data.Captions, htmlCaption{
+			c.text, template.CSS(cssColor(c.color)), captionFont, c.size, c.height, c.x, c.y, c.width,
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := htmlTemplate.Execute(&buf, &data); err != nil {
+		return errors.Wrap(err, "could not render html")
+	}
+
+	if err := ioutil.WriteFile(outputName, buf.Bytes(), 0644); err != nil {
+		return errors.Wrap(err, "could not write html")
+	}
+
+	return nil
+}
+
+func cssFontFace(family, path string) (string, error) {
+	font, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "could not read font")
+	}
+
+	return fmt.Sprintf(
+		`@font-face { font-family: "%s"; src: url(data:font/ttf;base64,%s) format("truetype"); }`,
+		family, base64.StdEncoding.EncodeToString(font),
+	), nil
+}
+
+var htmlTemplate = template.Must(template.New("poster").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+{{.FontFace}}
+body { margin: 0; background: #333; font-family: sans-serif; }
+#poster {
+  position: relative;
+  display: inline-block;
+  background: {{.Background}};
+  padding: {{.PadY}}px {{.PadX}}px;
+  font-family: "codeposter", monospace;
+  font-size: {{.FontSize}}px;
+  line-height: {{.CharHeight}}px;
+  white-space: pre;
+  cursor: pointer;
+}
+#poster div { height: {{.CharHeight}}px; }
+#poster span { display: inline-block; width: {{.CharWidth}}px; text-align: center; }
+#poster p { position: absolute; margin: 0; cursor: default; }
+#tip {
+  position: fixed; display: none; pointer-events: none;
+  background: rgba(0,0,0,.8); color: #fff; font-size: 12px;
+  padding: 2px 6px; border-radius: 3px;
+}
+#panel {
+  position: fixed; top: 0; right: 0; bottom: 0; width: 45%; display: none;
+  background: #1e1e1e; color: #ddd; overflow: auto; box-shadow: -2px 0 8px rgba(0,0,0,.5);
+}
+#panel header { position: sticky; top: 0; background: #111; padding: 6px 10px; font-size: 13px; }
+#panel header button { float: right; }
+#panel pre { margin: 0; font-family: "codeposter", monospace; font-size: 12px; }
+#panel .line { display: block; padding: 0 10px; }
+#panel .line.current { background: #444; }
+#panel .no { display: inline-block; width: 4em; color: #777; user-select: none; }
+#legend { color: #ddd; font-size: 13px; padding: 8px; }
+#legend span { margin-right: 16px; }
+</style>
+</head>
+<body>
+<div id="poster">{{range .Captions}}<p style="left: {{.X}}px; top: {{.Y}}px; color: {{.Color}}; font-family: '{{.Font}}'; font-size: {{.Size}}px; line-height: {{.Height}}px{{if .Width}}; width: {{.Width}}px; overflow: hidden; white-space: nowrap{{end}}">{{.Text}}</p>{{end}}</div>
+<div id="legend">{{range .Legend}}<span style="color: {{.Color}}">{{.Text}}</span>{{end}}</div>
+<div id="tip"></div>
+<div id="panel"><header><button id="close">close</button><span id="panel-title"></span></header><pre id="code"></pre></div>
+<script>
+(function() {
+  var rows = {{.Rows}};
+  var palette = {{.Palette}};
+  var colors = {{.Colors}};
+  var fileIndex = {{.FileIndex}};
+  var lines = {{.Lines}};
+  var columns = {{.Columns}};
+  var files = {{.Files}};
+  var sources = {{.Sources}};
+
+  var poster = document.getElementById("poster");
+  var tip = document.getElementById("tip");
+  var panel = document.getElementById("panel");
+  var code = document.getElementById("code");
+  var index = 0;
+
+  rows.forEach(function(row) {
+    var div = document.createElement("div");
+    for (var i = 0; i < row.length; i++, index++) {
+      var span = document.createElement("span");
+      span.textContent = row[i];
+      span.style.color = palette[colors[index]];
+      span.dataset.index = index;
+      div.appendChild(span);
+    }
+    poster.appendChild(div);
+  });
+
+  function cellOf(e) {
+    return e.target.dataset && e.target.dataset.index !== undefined ? +e.target.dataset.index : -1;
+  }
+
+  poster.addEventListener("mousemove", function(e) {
+    var i = cellOf(e);
+    if (i < 0) {
+      tip.style.display = "none";
+      return;
+    }
+    tip.textContent = files[fileIndex[i]] + ":" + lines[i] + ":" + columns[i];
+    tip.style.left = e.clientX + 12 + "px";
+    tip.style.top = e.clientY + 12 + "px";
+    tip.style.display = "block";
+  });
+
+  poster.addEventListener("mouseleave", function() {
+    tip.style.display = "none";
+  });
+
+  poster.addEventListener("click", function(e) {
+    var i = cellOf(e);
+    if (i < 0) {
+      return;
+    }
+    var f = fileIndex[i];
+    document.getElementById("panel-title").textContent = files[f] + ":" + lines[i];
+    code.textContent = "";
+    var current;
+    sources[f].split("\n").forEach(function(text, n) {
+      var line = document.createElement("span");
+      line.className = "line" + (n + 1 === lines[i] ? " current" : "");
+      var no = document.createElement("span");
+      no.className = "no";
+      no.textContent = n + 1;
+      line.appendChild(no);
+      line.appendChild(document.createTextNode(text));
+      code.appendChild(line);
+      if (n + 1 === lines[i]) {
+        current = line;
+      }
+    });
+    panel.style.display = "block";
+    if (current) {
+      current.scrollIntoView({block: "center"});
+    }
+  });
+
+  document.getElementById("close").addEventListener("click", function() {
+    panel.style.display = "none";
+  });
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"image"
+	imgcolor "image/color"
+	"math"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// sourceImage is the resized image used to color the poster, along with
+// what we know about its background
+type sourceImage struct {
+	img      image.Image
+	at       image.Point // top left corner of the image on the poster
+	poster   *background
+	bg       sdl.Color
+	detected bool   // bg is detected from the image
+	isBg     []bool // flood filled background, nil if flood fill is disabled
+}
+
+func newSourceImage(img image.Image, poster *background, at image.Point) *sourceImage {
+	src := &sourceImage{
+		img:    img,
+		at:     at,
+		poster: poster,
+		bg:     sdl.Color(config.bgColor),
+	}
+
+	if config.bgDetect {
+		if bg, ok := detectBackground(img); ok {
+			src.bg = bg
+			src.detected = true
+		}
+	}
+
+	if config.bgFlood {
+		src.isBg = floodBackground(img, src.bgAt, config.bgTolerance)
+	}
+
+	return src
+}
+
+// posterBg is the poster background under the image pixel x, y
+func (s *sourceImage) posterBg(x, y int) sdl.Color {
+	if s.poster.uniform() {
+		return sdl.Color(config.bgColor)
+	}
+
+	return s.poster.at(x+s.at.X, y+s.at.Y)
+}
+
+// bgAt is the background color expected at x, y of the image, the
+// detected one or else the poster background, which may be a gradient
+// or an image the source image was exported on
+func (s *sourceImage) bgAt(x, y int) sdl.Color {
+	if s.detected {
+		return s.bg
+	}
+
+	return s.posterBg(x, y)
+}
+
+// x, y are relative to image
+func (s *sourceImage) isBackground(x, y int, c sdl.Color) bool {
+	if s.isBg != nil {
+		return s.isBg[y*s.img.Bounds().Max.X+x]
+	}
+
+	return matchesBackground(c, s.bgAt(x, y), config.bgTolerance)
+}
+
+// matchesBackground compares colors, alpha has to be within tolerance
+// too so a tolerance of 0 is an exact match, nothing matches a
+// transparent background except transparent pixels which are skipped before
+func matchesBackground(c, bg sdl.Color, tolerance float64) bool {
+	return bg.A != 0 && math.Abs(float64(c.A)-float64(bg.A)) <= tolerance && colorDistance(c, bg) <= tolerance
+}
+
+// pixelColor returns the non-premultiplied color of the pixel
+func pixelColor(img image.Image, x, y int) sdl.Color {
+	return sdl.Color(imgcolor.NRGBAModel.Convert(img.At(x, y)).(imgcolor.NRGBA))
+}
+
+// euclidean distance in RGB space, 0 ~ 441
+func colorDistance(a, b sdl.Color) float64 {
+	dr := float64(a.R) - float64(b.R)
+	dg := float64(a.G) - float64(b.G)
+	db := float64(a.B) - float64(b.B)
+
+	return math.Sqrt(dr*dr + dg*dg + db*db)
+}
+
+// detectBackground picks the dominant color of the image border, pixels are
+// grouped into coarse buckets so that compression noise does not split them
+func detectBackground(img image.Image) (sdl.Color, bool) {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+
+	buckets := make(map[uint16]*bucket)
+	var best *bucket
+
+	visitBorder(img, func(x, y int) {
+		c := pixelColor(img, x, y)
+		if c.A == 0 {
+			return
+		}
+
+		key := uint16(c.R>>4)<<8 | uint16(c.G>>4)<<4 | uint16(c.B>>4)
+		bk := buckets[key]
+		if bk == nil {
+			bk = &bucket{}
+			buckets[key] = bk
+		}
+
+		bk.count++
+		bk.r += int(c.R)
+		bk.g += int(c.G)
+		bk.b += int(c.B)
+
+		if best == nil || bk.count > best.count {
+			best = bk
+		}
+	})
+
+	if best == nil {
+		return sdl.Color{}, false
+	}
+
+	return sdl.Color{
+		R: uint8(best.r / best.count),
+		G: uint8(best.g / best.count),
+		B: uint8(best.b / best.count),
+		A: 0xff,
+	}, true
+}
+
+// floodBackground marks background pixels reachable from the image edges,
+// transparent pixels are always passable
+func floodBackground(img image.Image, bgAt func(x, y int) sdl.Color, tolerance float64) []bool {
+	w := img.Bounds().Max.X
+	h := img.Bounds().Max.Y
+
+	result := make([]bool, w*h)
+	passable := func(x, y int) bool {
+		c := pixelColor(img, x, y)
+		return c.A == 0 || matchesBackground(c, bgAt(x, y), tolerance)
+	}
+
+	var stack []image.Point
+	push := func(x, y int) {
+		if x < 0 || x >= w || y < 0 || y >= h || result[y*w+x] {
+			return
+		}
+		if !passable(x, y) {
+			return
+		}
+		result[y*w+x] = true
+		stack = append(stack, image.Point{X: x, Y: y})
+	}
+
+	visitBorder(img, push)
+
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		push(p.X-1, p.Y)
+		push(p.X+1, p.Y)
+		push(p.X, p.Y-1)
+		push(p.X, p.Y+1)
+	}
+
+	return result
+}
+
+func visitBorder(img image.Image, fn func(x, y int)) {
+	w := img.Bounds().Max.X
+	h := img.Bounds().Max.Y
+
+	if w == 0 || h == 0 {
+		return
+	}
+
+	for x := 0; x < w; x++ {
+		fn(x, 0)
+		if h > 1 {
+			fn(x, h-1)
+		}
+	}
+
+	for y := 1; y < h-1; y++ {
+		fn(0, y)
+		if w > 1 {
+			fn(w-1, y)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+func TestMatchesBackground(t *testing.T) {
+	white := sdl.Color{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+
+	tests := []struct {
+		name      string
+		c, bg     sdl.Color
+		tolerance float64
+		want      bool
+	}{
+		{"exact", white, white, 0, true},
+		{"rgb differs", sdl.Color{R: 0xfe, G: 0xff, B: 0xff, A: 0xff}, white, 0, false},
+		{"rgb within tolerance", sdl.Color{R: 0xf0, G: 0xf0, B: 0xff, A: 0xff}, white, 30, true},
+		{"translucent same rgb", sdl.Color{R: 0xff, G: 0xff, B: 0xff, A: 0x80}, white, 0, false},
+		{"alpha within tolerance", sdl.Color{R: 0xff, G: 0xff, B: 0xff, A: 0xf0}, white, 20, true},
+		{"alpha past tolerance", sdl.Color{R: 0xff, G: 0xff, B: 0xff, A: 0x80}, white, 20, false},
+		{"transparent background", sdl.Color{}, sdl.Color{}, 441, false},
+	}
+
+	for _, test := range tests {
+		if got := matchesBackground(test.c, test.bg, test.tolerance); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,837 @@
+package main
+
+import (
+	"image"
+	imgcolor "image/color"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// Layout places the characters of the poster, the renderer and the
+// colorizers only see the cells it returns
+type Layout interface {
+	// Cells returns the cells of the poster in code order with their
+	// position, size and rotation, chars are filled in by the caller
+	Cells() ([]Cell, error)
+}
+
+// bleedLayout is a Layout which continues past the trim
+type bleedLayout interface {
+	Layout
+	// BleedCells returns cells drawn in area outside the content area
+	BleedCells(area image.Rectangle) []bleedCell
+}
+
+// bleedCell repeats a cell of the poster past the trim
+type bleedCell struct {
+	Cell
+	char  int // index of the cell whose char is drawn
+	color int // index of the cell whose color is used
+}
+
+func checkLayout() error {
+	if config.path != "" && config.layout != "path" {
+		return errors.New("--path is only used by the path layout")
+	}
+
+	if config.layout != "grid" && config.format == "html" {
+		return errors.Errorf("html format needs the grid layout, not %s", config.layout)
+	}
+
+	return nil
+}
+
+func newLayout(ctx *sdlContext, src *sourceImage) Layout {
+	cw, ch := float64(ctx.charWidth), float64(ctx.charHeight)
+
+	switch config.layout {
+	case "rotated":
+		return &lattice{ctx, cw, ch, ctx.charWidth, ctx.charHeight, 0, config.layoutAngle}
+	case "brick":
+		return &lattice{ctx, cw, ch, ctx.charWidth, ctx.charHeight, 0.5, 0}
+	case "hex":
+		// every character is a line height away from its six neighbours
+		return &lattice{ctx, ch, ch * math.Sqrt(3) / 2, ctx.charHeight, int(math.Round(ch * 2 / math.Sqrt(3))), 0.5, 0}
+	case "spiral", "circles", "path":
+		return &freeLayout{ctx, src}
+	}
+
+	return &rectLayout{&lattice{ctx, cw, ch, ctx.charWidth, ctx.charHeight, 0, 0}}
+}
+
+// gridSize is the number of columns and rows the cells span, for
+// layouts other than grid rows may be shorter than the widest one
+func gridSize(cells []Cell) (width, height int) {
+	for _, cell := range cells {
+		width = maxInt(width, cell.GridX+1)
+		height = maxInt(height, cell.GridY+1)
+	}
+
+	return width, height
+}
+
+func contentRect(ctx *sdlContext) image.Rectangle {
+	return image.Rect(0, 0, ctx.contentWidth, ctx.contentHeight).
+		Add(image.Pt(config.padding.horizontal*ctx.charWidth, config.padding.vertical*ctx.charHeight))
+}
+
+// lattice lays cells out in rows from the top left of the content area,
+// odd rows shifted by stagger of a cell, then rotates the rows about
+// the center of the content area, cells which do not fit are left out
+type lattice struct {
+	ctx           *sdlContext
+	dx, dy        float64 // distance between cells and between rows
+	width, height int     // cell size in pixels
+	stagger       float64 // in cells
+	angle         float64 // clockwise in degrees
+}
+
+func (l *lattice) Cells() ([]Cell, error) {
+	content := contentRect(l.ctx)
+	cx, cy := float64(content.Min.X+content.Max.X)/2, float64(content.Min.Y+content.Max.Y)/2
+	sin, cos := math.Sincos(l.angle * math.Pi / 180)
+
+	// center of the first cell, relative to the center of the content
+	ox, oy := float64(content.Min.X)+l.dx/2-cx, float64(content.Min.Y)+l.dy/2-cy
+
+	// corners of the content area in unrotated lattice coordinates
+	// bound the rows and cells to try
+	minI, maxI, minJ, maxJ := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+	for _, corner := range []image.Point{content.Min, content.Max, {content.Min.X, content.Max.Y}, {content.Max.X, content.Min.Y}} {
+		x, y := float64(corner.X)-cx, float64(corner.Y)-cy
+		i, j := (x*cos+y*sin-ox)/l.dx, (-x*sin+y*cos-oy)/l.dy
+		minI, maxI = math.Min(minI, i), math.Max(maxI, i)
+		minJ, maxJ = math.Min(minJ, j), math.Max(maxJ, j)
+	}
+
+	// half the extent of a rotated cell, which has to be inside
+	extentX := (math.Abs(float64(l.width)*cos) + math.Abs(float64(l.height)*sin)) / 2
+	extentY := (math.Abs(float64(l.width)*sin) + math.Abs(float64(l.height)*cos)) / 2
+	const epsilon = 1e-6
+
+	var result []Cell
+	row := 0
+	for j := int(math.Floor(minJ)) - 1; j <= int(math.Ceil(maxJ))+1; j++ {
+		col := 0
+		for i := int(math.Floor(minI)) - 1; i <= int(math.Ceil(maxI))+1; i++ {
+			u := ox + (float64(i)+l.stagger*float64(mod(j, 2)))*l.dx
+			v := oy + float64(j)*l.dy
+			x, y := cx+u*cos-v*sin, cy+u*sin+v*cos
+
+			if x-extentX < float64(content.Min.X)-epsilon || x+extentX > float64(content.Max.X)+epsilon ||
+				y-extentY < float64(content.Min.Y)-epsilon || y+extentY > float64(content.Max.Y)+epsilon {
+				continue
+			}
+
+			result = append(result, Cell{
+				GridX:  col,
+				GridY:  row,
+				PixelX: int(math.Floor(x)),
+				PixelY: int(math.Floor(y)),
+				Width:  l.width,
+				Height: l.height,
+				Angle:  l.angle,
+			})
+			col++
+		}
+
+		if col > 0 {
+			row++
+		}
+	}
+
+	return result, nil
+}
+
+// rectLayout is the width x height grid of characters, without padding
+// it continues into the bleed
+type rectLayout struct {
+	*lattice
+}
+
+func (l *rectLayout) BleedCells(area image.Rectangle) []bleedCell {
+	cw, ch := l.ctx.charWidth, l.ctx.charHeight
+	padX, padY := config.padding.horizontal*cw, config.padding.vertical*ch
+
+	minX, maxX := 0, config.width-1
+	if config.padding.horizontal == 0 {
+		minX, maxX = floorDiv(area.Min.X-padX, cw), floorDiv(area.Max.X-1-padX, cw)
+	}
+	minY, maxY := 0, config.height-1
+	if config.padding.vertical == 0 {
+		minY, maxY = floorDiv(area.Min.Y-padY, ch), floorDiv(area.Max.Y-1-padY, ch)
+	}
+
+	var result []bleedCell
+	for cy := minY; cy <= maxY; cy++ {
+		for cx := minX; cx <= maxX; cx++ {
+			if cx >= 0 && cx < config.width && cy >= 0 && cy < config.height {
+				continue
+			}
+
+			// cells past the trim repeat the code and take the color of
+			// the nearest cell
+			result = append(result, bleedCell{
+				Cell: Cell{
+					GridX:  cx,
+					GridY:  cy,
+					PixelX: padX + cx*cw + cw/2,
+					PixelY: padY + cy*ch + ch/2,
+					Width:  cw,
+					Height: ch,
+				},
+				char:  mod(cy, config.height)*config.width + mod(cx, config.width),
+				color: clampInt(cy, 0, config.height-1)*config.width + clampInt(cx, 0, config.width-1),
+			})
+		}
+	}
+
+	return result
+}
+
+// freeLayout lays characters out along a spiral, circles or contours
+type freeLayout struct {
+	ctx *sdlContext
+	src *sourceImage
+}
+
+func (l *freeLayout) Cells() ([]Cell, error) {
+	placements, err := freePlacements(l.ctx, l.src)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Cell, len(placements))
+	for i, p := range placements {
+		result[i] = Cell{
+			GridX:  p.index,
+			GridY:  p.line,
+			PixelX: int(math.Round(p.x)),
+			PixelY: int(math.Round(p.y)),
+			Width:  l.ctx.charWidth,
+			Height: l.ctx.charHeight,
+			Angle:  p.angle,
+		}
+	}
+
+	return result, nil
+}
+
+// placement is where a character of a free layout goes
+type placement struct {
+	x, y  float64 // center in pixels
+	angle float64 // clockwise in degrees, 0 is upright
+	line  int     // turn of the spiral, circle or contour
+	index int     // position in its line
+}
+
+// freePlacements lays out characters along a spiral, circles or
+// contours inside the content area, src gives the outline of the path
+// layout when there is no svg path
+func freePlacements(ctx *sdlContext, src *sourceImage) ([]placement, error) {
+	content := contentRect(ctx)
+
+	var result []placement
+	switch config.layout {
+	case "spiral":
+		result = spiralPlacements(content, float64(ctx.charWidth), float64(ctx.charHeight))
+	case "circles":
+		result = circlePlacements(content, float64(ctx.charWidth), float64(ctx.charHeight))
+	case "path":
+		var mask *image.Alpha
+		var err error
+		if config.path != "" {
+			mask, err = svgMask(config.path, content)
+		} else {
+			mask = imageMask(src, content)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = contourPlacements(mask, float64(ctx.charWidth), float64(ctx.charHeight))
+	}
+
+	return result, nil
+}
+
+// spiralPlacements follows an archimedean spiral from the center, turns
+// are a line apart and it stops at the circle inscribed in the content
+func spiralPlacements(content image.Rectangle, cw, ch float64) []placement {
+	cx, cy := float64(content.Min.X+content.Max.X)/2, float64(content.Min.Y+content.Max.Y)/2
+	maxR := math.Min(float64(content.Dx()), float64(content.Dy()))/2 - ch/2
+
+	// r = b * theta, starting one line away from the center
+	b := ch / (2 * math.Pi)
+	start := 2 * math.Pi
+
+	var result []placement
+	index := 0
+	for theta := start; b*theta <= maxR; {
+		r := b * theta
+		sin, cos := math.Sincos(theta)
+
+		// tangent of the spiral
+		tx, ty := b*cos-r*sin, b*sin+r*cos
+
+		line := int((theta - start) / (2 * math.Pi))
+		if len(result) > 0 && result[len(result)-1].line != line {
+			index = 0
+		}
+
+		result = append(result, placement{cx + r*cos, cy + r*sin, math.Atan2(ty, tx) * 180 / math.Pi, line, index})
+		index++
+
+		// next character one char width along the arc
+		theta += cw / math.Hypot(r, b)
+	}
+
+	return result
+}
+
+// circlePlacements fills concentric circles a line apart, from the
+// outermost one, each starting at the top
+func circlePlacements(content image.Rectangle, cw, ch float64) []placement {
+	cx, cy := float64(content.Min.X+content.Max.X)/2, float64(content.Min.Y+content.Max.Y)/2
+	maxR := math.Min(float64(content.Dx()), float64(content.Dy()))/2 - ch/2
+
+	var result []placement
+	for line, r := 0, maxR; r >= ch/2; line, r = line+1, r-ch {
+		n := int(2 * math.Pi * r / cw)
+		for i := 0; i < n; i++ {
+			phi := -math.Pi/2 + 2*math.Pi*float64(i)/float64(n)
+			sin, cos := math.Sincos(phi)
+			result = append(result, placement{cx + r*cos, cy + r*sin, phi*180/math.Pi + 90, line, i})
+		}
+	}
+
+	return result
+}
+
+// imageMask is the part of the source image which is not background,
+// in poster coordinates and cut to the content area
+func imageMask(src *sourceImage, content image.Rectangle) *image.Alpha {
+	mask := image.NewAlpha(content)
+	b := src.img.Bounds()
+
+	for y := 0; y < b.Max.Y; y++ {
+		for x := 0; x < b.Max.X; x++ {
+			c := pixelColor(src.img, x, y)
+			if c.A != 0 && !src.isBackground(x, y, c) {
+				mask.SetAlpha(x+src.at.X, y+src.at.Y, imgcolor.Alpha{A: 0xff})
+			}
+		}
+	}
+
+	return mask
+}
+
+var (
+	svgPathReg   = regexp.MustCompile(`<path\b[^>]*?\sd\s*=\s*("[^"]*"|'[^']*')`)
+	svgNumberReg = regexp.MustCompile(`[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?`)
+)
+
+// svgArity is the number of arguments of path commands
+var svgArity = map[rune]int{'m': 2, 'l': 2, 'h': 1, 'v': 1, 'c': 6, 's': 4, 'q': 4, 't': 2, 'a': 7, 'z': 0}
+
+// svgMask fills the paths of an svg file, scaled to fit the content area
+func svgMask(path string, content image.Rectangle) (*image.Alpha, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read svg path")
+	}
+
+	var polygons [][][2]float64
+	for _, match := range svgPathReg.FindAllStringSubmatch(string(data), -1) {
+		d := match[1][1 : len(match[1])-1]
+		parsed, err := parseSVGPath(d)
+		if err != nil {
+			return nil, err
+		}
+		polygons = append(polygons, parsed...)
+	}
+
+	if len(polygons) == 0 {
+		return nil, errors.New("there is no path in the svg file")
+	}
+
+	// bounds of the paths
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, polygon := range polygons {
+		for _, p := range polygon {
+			minX, maxX = math.Min(minX, p[0]), math.Max(maxX, p[0])
+			minY, maxY = math.Min(minY, p[1]), math.Max(maxY, p[1])
+		}
+	}
+	if maxX <= minX || maxY <= minY {
+		return nil, errors.New("svg path is empty")
+	}
+
+	scale := math.Min(float64(content.Dx())/(maxX-minX), float64(content.Dy())/(maxY-minY))
+	offsetX := float64(content.Min.X) + (float64(content.Dx())-(maxX-minX)*scale)/2
+	offsetY := float64(content.Min.Y) + (float64(content.Dy())-(maxY-minY)*scale)/2
+	for _, polygon := range polygons {
+		for i, p := range polygon {
+			polygon[i] = [2]float64{(p[0]-minX)*scale + offsetX, (p[1]-minY)*scale + offsetY}
+		}
+	}
+
+	return fillPolygons(polygons, content), nil
+}
+
+// parseSVGPath flattens path data into polygons, curves are sampled
+// and arcs become straight lines to their end
+func parseSVGPath(d string) ([][][2]float64, error) {
+	var (
+		result  [][][2]float64
+		current [][2]float64
+		x, y    float64
+		startX  float64
+		startY  float64
+		ctrlX   float64 // last control point, for s and t
+		ctrlY   float64
+	)
+
+	numbers := func(s string) []float64 {
+		var values []float64
+		for _, n := range svgNumberReg.FindAllString(s, -1) {
+			v, _ := strconv.ParseFloat(n, 64)
+			values = append(values, v)
+		}
+		return values
+	}
+
+	closePolygon := func() {
+		if len(current) > 2 {
+			result = append(result, current)
+		}
+		current = nil
+	}
+
+	lineTo := func(nx, ny float64) {
+		if current == nil {
+			current = append(current, [2]float64{x, y})
+		}
+		current = append(current, [2]float64{nx, ny})
+		x, y = nx, ny
+	}
+
+	const curveSteps = 16
+	cubic := func(x1, y1, x2, y2, x3, y3 float64) {
+		x0, y0 := x, y
+		for i := 1; i <= curveSteps; i++ {
+			t := float64(i) / curveSteps
+			u := 1 - t
+			lineTo(
+				u*u*u*x0+3*u*u*t*x1+3*u*t*t*x2+t*t*t*x3,
+				u*u*u*y0+3*u*u*t*y1+3*u*t*t*y2+t*t*t*y3,
+			)
+		}
+		ctrlX, ctrlY = x2, y2
+	}
+	quad := func(x1, y1, x2, y2 float64) {
+		x0, y0 := x, y
+		for i := 1; i <= curveSteps; i++ {
+			t := float64(i) / curveSteps
+			u := 1 - t
+			lineTo(u*u*x0+2*u*t*x1+t*t*x2, u*u*y0+2*u*t*y1+t*t*y2)
+		}
+		ctrlX, ctrlY = x1, y1
+	}
+
+	// split into commands and their arguments
+	start := -1
+	var parts []string
+	for i, r := range d {
+		if unicode.IsLetter(r) && r != 'e' && r != 'E' {
+			if start >= 0 {
+				parts = append(parts, d[start:i])
+			}
+			start = i
+		}
+	}
+	if start >= 0 {
+		parts = append(parts, d[start:])
+	}
+
+	for _, part := range parts {
+		command := rune(part[0])
+		args := numbers(part[1:])
+		relative := unicode.IsLower(command)
+		rel := func(vx, vy float64) (float64, float64) {
+			if relative {
+				return x + vx, y + vy
+			}
+			return vx, vy
+		}
+
+		cmd := unicode.ToLower(command)
+		arity, ok := svgArity[cmd]
+		if !ok {
+			return nil, errors.Errorf("unknown svg path command %c", command)
+		}
+		if arity > 0 && (len(args) == 0 || len(args)%arity != 0) {
+			return nil, errors.Errorf("svg path command %c has %d arguments", command, len(args))
+		}
+
+		if cmd == 'z' {
+			closePolygon()
+			x, y = startX, startY
+			continue
+		}
+
+		for i := 0; i < len(args); i += arity {
+			a := args[i : i+arity]
+			switch cmd {
+			case 'm':
+				nx, ny := rel(a[0], a[1])
+				if i == 0 {
+					closePolygon()
+					x, y = nx, ny
+					startX, startY = nx, ny
+				} else {
+					// following pairs are line tos
+					lineTo(nx, ny)
+				}
+			case 'l':
+				lineTo(rel(a[0], a[1]))
+			case 'h':
+				nx := a[0]
+				if relative {
+					nx += x
+				}
+				lineTo(nx, y)
+			case 'v':
+				ny := a[0]
+				if relative {
+					ny += y
+				}
+				lineTo(x, ny)
+			case 'c':
+				x1, y1 := rel(a[0], a[1])
+				x2, y2 := rel(a[2], a[3])
+				x3, y3 := rel(a[4], a[5])
+				cubic(x1, y1, x2, y2, x3, y3)
+			case 's':
+				x2, y2 := rel(a[0], a[1])
+				x3, y3 := rel(a[2], a[3])
+				cubic(2*x-ctrlX, 2*y-ctrlY, x2, y2, x3, y3)
+			case 'q':
+				x1, y1 := rel(a[0], a[1])
+				x2, y2 := rel(a[2], a[3])
+				quad(x1, y1, x2, y2)
+			case 't':
+				x2, y2 := rel(a[0], a[1])
+				quad(2*x-ctrlX, 2*y-ctrlY, x2, y2)
+			case 'a':
+				lineTo(rel(a[5], a[6]))
+			}
+
+			if cmd != 'c' && cmd != 's' && cmd != 'q' && cmd != 't' {
+				ctrlX, ctrlY = x, y
+			}
+		}
+	}
+	closePolygon()
+
+	return result, nil
+}
+
+// fillPolygons rasterizes polygons with the even-odd rule, a scanline
+// at a time
+func fillPolygons(polygons [][][2]float64, bounds image.Rectangle) *image.Alpha {
+	mask := image.NewAlpha(bounds)
+
+	var crossings []float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		py := float64(y) + 0.5
+		crossings = crossings[:0]
+
+		for _, polygon := range polygons {
+			for i := range polygon {
+				a, b := polygon[i], polygon[(i+1)%len(polygon)]
+				if (a[1] <= py) != (b[1] <= py) {
+					crossings = append(crossings, a[0]+(py-a[1])/(b[1]-a[1])*(b[0]-a[0]))
+				}
+			}
+		}
+
+		sort.Float64s(crossings)
+		for i := 0; i+1 < len(crossings); i += 2 {
+			from := clampInt(int(math.Ceil(crossings[i]-0.5)), bounds.Min.X, bounds.Max.X)
+			to := clampInt(int(math.Ceil(crossings[i+1]-0.5)), bounds.Min.X, bounds.Max.X)
+			for x := from; x < to; x++ {
+				mask.Pix[mask.PixOffset(x, y)] = 0xff
+			}
+		}
+	}
+
+	return mask
+}
+
+// contourPlacements writes along contour lines of the mask, the outline
+// first, then lines a line height further inside each time
+func contourPlacements(mask *image.Alpha, cw, ch float64) []placement {
+	dist := distanceField(mask)
+
+	var result []placement
+	line := 0
+	for level := ch / 2; ; level += ch {
+		contours := contourLines(dist, mask.Bounds(), level)
+		if len(contours) == 0 {
+			break
+		}
+
+		for _, contour := range contours {
+			placed := placeAlong(contour, cw, line)
+			if len(placed) > 0 {
+				result = append(result, placed...)
+				line++
+			}
+		}
+	}
+
+	return result
+}
+
+// distanceField gives every pixel inside the mask its distance to the
+// outside, by a 3-4 chamfer transform
+func distanceField(mask *image.Alpha) []float64 {
+	b := mask.Bounds()
+	w, h := b.Dx(), b.Dy()
+	inf := math.Inf(1)
+
+	dist := make([]float64, w*h)
+	for i := range dist {
+		if mask.Pix[i%w+(i/w)*mask.Stride] != 0 {
+			dist[i] = inf
+		}
+	}
+
+	at := func(x, y int) float64 {
+		if x < 0 || x >= w || y < 0 || y >= h {
+			return 0 // outside the content area
+		}
+		return dist[y*w+x]
+	}
+
+	relax := func(x, y int, neighbours [][3]int) {
+		i := y*w + x
+		for _, n := range neighbours {
+			if d := at(x+n[0], y+n[1]) + float64(n[2]); d < dist[i] {
+				dist[i] = d
+			}
+		}
+	}
+
+	forward := [][3]int{{-1, 0, 3}, {-1, -1, 4}, {0, -1, 3}, {1, -1, 4}}
+	backward := [][3]int{{1, 0, 3}, {1, 1, 4}, {0, 1, 3}, {-1, 1, 4}}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			relax(x, y, forward)
+		}
+	}
+	for y := h - 1; y >= 0; y-- {
+		for x := w - 1; x >= 0; x-- {
+			relax(x, y, backward)
+		}
+	}
+
+	for i := range dist {
+		dist[i] /= 3
+	}
+
+	return dist
+}
+
+// contourLines traces where the distance field crosses level by
+// marching squares, lines are returned in poster coordinates running
+// clockwise
+func contourLines(dist []float64, bounds image.Rectangle, level float64) [][][2]float64 {
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// samples on a grid a few pixels apart with a border outside of the
+	// mask, so all lines are closed
+	const step = 2
+	cols, rows := w/step+3, h/step+3
+	value := func(i, j int) float64 {
+		x, y := (j-1)*step, (i-1)*step
+		if x < 0 || x >= w || y < 0 || y >= h {
+			return -level
+		}
+		return dist[y*w+x] - level
+	}
+
+	values := make([]float64, cols*rows)
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			values[i*cols+j] = value(i, j)
+		}
+	}
+
+	// an edge between two samples, horizontal or vertical
+	type edge struct {
+		i, j     int
+		vertical bool
+	}
+
+	point := func(e edge) [2]float64 {
+		i2, j2 := e.i, e.j+1
+		if e.vertical {
+			i2, j2 = e.i+1, e.j
+		}
+		a, b := values[e.i*cols+e.j], values[i2*cols+j2]
+		t := a / (a - b)
+		x := float64(e.j-1)*step + t*float64(j2-e.j)*step
+		y := float64(e.i-1)*step + t*float64(i2-e.i)*step
+		return [2]float64{x + float64(bounds.Min.X) + 0.5, y + float64(bounds.Min.Y) + 0.5}
+	}
+
+	links := make(map[edge][]edge)
+	link := func(a, b edge) {
+		links[a] = append(links[a], b)
+		links[b] = append(links[b], a)
+	}
+
+	for i := 0; i+1 < rows; i++ {
+		for j := 0; j+1 < cols; j++ {
+			top, right := edge{i, j, false}, edge{i, j + 1, true}
+			bottom, left := edge{i + 1, j, false}, edge{i, j, true}
+
+			inside := func(i, j int) bool { return values[i*cols+j] > 0 }
+			var crossed []edge
+			if inside(i, j) != inside(i, j+1) {
+				crossed = append(crossed, top)
+			}
+			if inside(i, j+1) != inside(i+1, j+1) {
+				crossed = append(crossed, right)
+			}
+			if inside(i+1, j+1) != inside(i+1, j) {
+				crossed = append(crossed, bottom)
+			}
+			if inside(i+1, j) != inside(i, j) {
+				crossed = append(crossed, left)
+			}
+
+			switch len(crossed) {
+			case 2:
+				link(crossed[0], crossed[1])
+			case 4:
+				// saddle, the center decides which corners are joined
+				center := values[i*cols+j] + values[i*cols+j+1] + values[(i+1)*cols+j] + values[(i+1)*cols+j+1]
+				if (center > 0) == inside(i, j) {
+					link(top, right)
+					link(bottom, left)
+				} else {
+					link(top, left)
+					link(bottom, right)
+				}
+			}
+		}
+	}
+
+	// walk the links into lines, in a stable order
+	starts := make([]edge, 0, len(links))
+	for e := range links {
+		starts = append(starts, e)
+	}
+	sort.Slice(starts, func(a, b int) bool {
+		if starts[a].i != starts[b].i {
+			return starts[a].i < starts[b].i
+		}
+		if starts[a].j != starts[b].j {
+			return starts[a].j < starts[b].j
+		}
+		return !starts[a].vertical && starts[b].vertical
+	})
+
+	visited := make(map[edge]bool)
+	var result [][][2]float64
+	for _, start := range starts {
+		if visited[start] {
+			continue
+		}
+
+		var line [][2]float64
+		prev, cur := edge{-1, -1, false}, start
+		for {
+			visited[cur] = true
+			line = append(line, point(cur))
+
+			next := edge{-1, -1, false}
+			for _, n := range links[cur] {
+				if n != prev && !visited[n] {
+					next = n
+					break
+				}
+			}
+			if next.i < 0 {
+				break
+			}
+			prev, cur = cur, next
+		}
+
+		if len(line) < 3 {
+			continue
+		}
+
+		// clockwise on screen has a positive area with y going down
+		area := 0.0
+		for k := range line {
+			a, b := line[k], line[(k+1)%len(line)]
+			area += a[0]*b[1] - b[0]*a[1]
+		}
+		if area < 0 {
+			for a, b := 0, len(line)-1; a < b; a, b = a+1, b-1 {
+				line[a], line[b] = line[b], line[a]
+			}
+		}
+
+		result = append(result, append(line, line[0]))
+	}
+
+	return result
+}
+
+// placeAlong puts characters a char width apart on a polyline, each is
+// rotated along the chord it covers so small wiggles are smoothed out
+func placeAlong(polyline [][2]float64, cw float64, line int) []placement {
+	lengths := make([]float64, len(polyline))
+	for i := 1; i < len(polyline); i++ {
+		lengths[i] = lengths[i-1] + math.Hypot(polyline[i][0]-polyline[i-1][0], polyline[i][1]-polyline[i-1][1])
+	}
+	total := lengths[len(lengths)-1]
+
+	pointAt := func(s float64) (float64, float64) {
+		k := sort.SearchFloat64s(lengths, s)
+		if k <= 0 {
+			return polyline[0][0], polyline[0][1]
+		}
+		if k >= len(polyline) {
+			last := polyline[len(polyline)-1]
+			return last[0], last[1]
+		}
+		a, b := polyline[k-1], polyline[k]
+		t := 0.0
+		if seg := lengths[k] - lengths[k-1]; seg > 0 {
+			t = (s - lengths[k-1]) / seg
+		}
+		return a[0] + (b[0]-a[0])*t, a[1] + (b[1]-a[1])*t
+	}
+
+	var result []placement
+	for i, s := 0, cw/2; s+cw/2 <= total; i, s = i+1, s+cw {
+		x, y := pointAt(s)
+		x0, y0 := pointAt(s - cw/2)
+		x1, y1 := pointAt(s + cw/2)
+		result = append(result, placement{x, y, math.Atan2(y1-y0, x1-x0) * 180 / math.Pi, line, i})
+	}
+
+	return result
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseSVGPath(t *testing.T) {
+	square := [][][2]float64{{{0, 0}, {10, 0}, {10, 10}, {0, 10}}}
+
+	tests := []struct {
+		d    string
+		want [][][2]float64
+	}{
+		{"M0 0 L10 0 L10 10 L0 10 Z", square},
+		{"m0 0 l10 0 l0 10 l-10 0 z", square},
+		{"M0,0 H10 V10 H0 Z", square},
+		{"M0 0 h10 v10 h-10z", square},
+		{"M0 0 10 0 10 10 0 10 Z", square},              // implicit line tos
+		{"M0 0 L10 0 10 10 0 10", square},               // repeated arguments, closed at the end
+		{"M0 0L1e1 0L10 1e1L0 10Z", square},             // exponents are not commands
+		{"M0-0L10-0L10 10L-0 10Z", square},              // signs separate numbers
+		{"M0 0 A5 5 0 0 1 10 0 L10 10 L0 10 Z", square}, // arcs end in a straight line
+		{"M0 0 L10 0 Z", nil},                           // too few points
+		{
+			"M0 0 L1 0 L1 1 Z m5 5 l1 0 l0 1 z",
+			[][][2]float64{{{0, 0}, {1, 0}, {1, 1}}, {{5, 5}, {6, 5}, {6, 6}}},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseSVGPath(test.d)
+		if err != nil {
+			t.Errorf("parseSVGPath(%q) failed: %v", test.d, err)
+			continue
+		}
+		if !polygonsEqual(got, test.want) {
+			t.Errorf("parseSVGPath(%q) = %v, want %v", test.d, got, test.want)
+		}
+	}
+}
+
+func TestParseSVGPathCurves(t *testing.T) {
+	got, err := parseSVGPath("M0 0 C0 10 10 10 10 0 S20 -10 20 0 Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || len(got[0]) != 1+2*16 {
+		t.Fatalf("got %d polygons, want one of %d points", len(got), 1+2*16)
+	}
+
+	// the reflected control point of s mirrors the curve below
+	polygon := got[0]
+	for i := 1; i <= 16; i++ {
+		a, b := polygon[i], polygon[16+i]
+		if math.Abs(a[0]+10-b[0]) > 1e-9 || math.Abs(a[1]+b[1]) > 1e-9 {
+			t.Fatalf("point %v of s is not the mirror of %v", b, a)
+		}
+	}
+
+	got, err = parseSVGPath("M0 0 q5 10 10 0 t10 0 Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := got[0][len(got[0])-1]; math.Abs(last[0]-20) > 1e-9 || math.Abs(last[1]) > 1e-9 {
+		t.Errorf("relative quadratic curves end at %v, want 20,0", last)
+	}
+}
+
+func TestParseSVGPathErrors(t *testing.T) {
+	for _, d := range []string{
+		"M0 0 X1 1",     // unknown command
+		"M0 0 L10",      // odd number of arguments
+		"M0 0 C1 2 3 4", // too few arguments
+		"M",             // no arguments
+		"M0 0 H",
+	} {
+		if _, err := parseSVGPath(d); err == nil {
+			t.Errorf("parseSVGPath(%q) should fail", d)
+		}
+	}
+}
+
+func polygonsEqual(a, b [][][2]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if math.Abs(a[i][j][0]-b[i][j][0]) > 1e-9 || math.Abs(a[i][j][1]-b[i][j][1]) > 1e-9 {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -4,22 +4,27 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	imgcolor "image/color"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/cj1128/codeposter/colorize"
 	"github.com/nfnt/resize"
-	sdlimg "github.com/veandco/go-sdl2/img"
 	"github.com/veandco/go-sdl2/sdl"
 	"github.com/veandco/go-sdl2/ttf"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -31,21 +36,128 @@ var appVersion string
 const defaultFont = "Hack-Regular.ttf"
 const defaultImage = "gopher.png"
 
-var config struct {
+// configuration is set by flags only, state which outlives a batch job,
+// like sdl and the font cache, is kept outside of it
+type configuration struct {
 	sourcePath string
 	imgPath    string
 	fontPath   string
 	fontSize   int
 	bgColor    color
 	codeColor  color
-	padding    padding
-	width      int // in chars
-	height     int // in chars
+
+	bgImage        string
+	bgFit          string
+	bgOpacity      float64
+	bgGradient     colorList
+	bgGradientType string
+	bgAngle        float64
+
+	underlay     float64 // opacity
+	underlayBlur int
+
+	layout      string
+	layoutAngle float64 // rotated layout, clockwise in degrees
+	path        string  // svg file of the path layout
+
+	padding padding
+	width   int // in chars
+	height  int // in chars
+
+	bgDetect    bool
+	bgTolerance float64
+	bgFlood     bool
+
+	alphaMode      string
+	alphaThreshold int
+
+	adjustments adjustments
+
+	palette palette
+	dither  string
+
+	maskText     string
+	maskFontPath string
+	maskColors   colorList
+
+	shape        string
+	sides        int
+	fill         color
+	gradient     colorList
+	gradientType string
+	angle        float64
+
+	coverProfile   string
+	coveredColor   color
+	uncoveredColor color
+	coverageBlend  float64
+
+	blame       string
+	blameColors colorList
+
+	pprofPath  string
+	pprofMode  string
+	heatColors colorList
+
+	colorizers colorizerSpecs
+
+	plugin        string
+	pluginTimeout time.Duration
+
+	sourceMapPath string
+
+	title        string
+	subtitle     string
+	footer       string
+	captionFont  string
+	titleSize    int
+	subtitleSize int
+	footerSize   int
+	captionColor color
+	captionAlign string
+
+	border       string
+	borderWidth  padding // in chars
+	borderColor  color
+	cornerRadius int // in chars
+	shadow       padding
+	shadowColor  color
+	vignette     float64
+	codeFrame    padding
+	frameColor   color
+
+	format    string
+	dpi       int
+	bleed     float64 // mm
+	cropMarks bool
+	cmykGCR   string
+
+	print          string
+	printDPI       int
+	printOverlap   float64 // mm
+	printLandscape bool
+	printFormat    string
+
+	postcardMessage  string
+	postcardTo       []string
+	postcardTemplate string
+
+	output string
+
+	batchPath    string
+	batchWorkers int
 }
 
+var config configuration
+
 type color sdl.Color
 
 func (c *color) Set(value string) error {
+	if value == "transparent" {
+		*c = color{}
+		return nil
+	}
+
 	if !colorReg.MatchString(value) {
 		return errInvalidColor
 	}
@@ -89,6 +201,34 @@ func (c *color) String() string {
 	return fmt.Sprintf("#%2x%2x%2x%2x(rgba)", c.R, c.G, c.B, c.A)
 }
 
+// colorList is a comma separated list of colors, e.g. '#f00,#00f'
+type colorList []sdl.Color
+
+func (l *colorList) Set(value string) error {
+	var result colorList
+
+	for _, part := range strings.Split(value, ",") {
+		var c color
+		if err := c.Set(strings.TrimSpace(part)); err != nil {
+			return err
+		}
+		result = append(result, sdl.Color(c))
+	}
+
+	*l = result
+
+	return nil
+}
+
+func (l *colorList) String() string {
+	parts := make([]string, len(*l))
+	for i, c := range *l {
+		parts[i] = fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+	}
+
+	return strings.Join(parts, ",")
+}
+
 type padding struct {
 	horizontal int
 	vertical   int
@@ -127,43 +267,91 @@ var colorReg = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6}|[0-9a-fA-F]{
 
 var errInvalidColor = errors.New("color should be '#rgb' or '#rrggbb' or '#rrggbbaa'")
 
-type fontTexture struct {
-	texture *sdl.Texture
-	w       int32
-	h       int32
+var (
+	sdlInitialized  bool
+	defaultFontPath string // bundled font extracted to a temporary file
+	fonts           = make(map[fontKey]*ttf.Font)
+)
+
+type fontKey struct {
+	path string
+	size int
+}
+
+// extractDefaultFont writes the bundled font to a temporary file once
+func extractDefaultFont() error {
+	if defaultFontPath != "" {
+		return nil
+	}
+
+	tmpFile, err := ioutil.TempFile("", "codeposter")
+	if err != nil {
+		return errors.Wrap(err, "couldn't create temporary file")
+	}
+	defer tmpFile.Close()
+
+	buf, _ := Asset(defaultFont)
+	if _, err := tmpFile.Write(buf); err != nil {
+		return errors.Wrap(err, "could not write to temporary file")
+	}
+
+	defaultFontPath = tmpFile.Name()
+
+	return nil
+}
+
+// openFont opens a font once and keeps it open for later posters
+func openFont(path string, size int) (*ttf.Font, error) {
+	key := fontKey{path, size}
+	if font, ok := fonts[key]; ok {
+		return font, nil
+	}
+
+	font, err := ttf.OpenFont(path, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open font")
+	}
+	fonts[key] = font
+
+	return font, nil
 }
 
 type sdlContext struct {
-	win           *sdl.Window
-	winSurface    *sdl.Surface
-	renderer      *sdl.Renderer
 	font          *ttf.Font
 	padding       padding
 	charWidth     int
 	charHeight    int
 	winWidth      int
 	winHeight     int
-	contentWidth  int // without padding
-	contentHeight int // without padding
+	contentWidth  int         // without padding
+	contentHeight int         // without padding
+	background    *background // built once, shared by all renderers
+	underlay      *image.RGBA // drawn under the code, nil if disabled
+	layout        Layout
+	scale         float64 // font size relative to --font-size, other sizes in pixels follow it
 }
 
-// char: ASCII character, 0x20 ~ 0x7e inclusive
-func renderChar(font *ttf.Font, renderer *sdl.Renderer, char byte, color sdl.Color) (*fontTexture, error) {
-	result := &fontTexture{}
-
-	surface, err := font.RenderUTF8Blended(string(char), color)
+// surfaceToImage copies pixels of a sdl surface into a go image
+func surfaceToImage(surface *sdl.Surface) (*image.NRGBA, error) {
+	converted, err := surface.ConvertFormat(uint32(sdl.PIXELFORMAT_RGBA32), 0)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not render font")
+		return nil, errors.Wrap(err, "could not convert surface format")
 	}
+	defer converted.Free()
 
-	texture, err := renderer.CreateTextureFromSurface(surface)
-	if err != nil {
-		return nil, errors.Wrap(err, "could not create texture from surface")
+	w, h := int(converted.W), int(converted.H)
+	result := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	if err := converted.Lock(); err != nil {
+		return nil, errors.Wrap(err, "could not lock surface")
 	}
+	defer converted.Unlock()
 
-	result.texture = texture
-	result.w = surface.W
-	result.h = surface.H
+	pixels := converted.Pixels()
+	pitch := int(converted.Pitch)
+	for y := 0; y < h; y++ {
+		copy(result.Pix[y*result.Stride:y*result.Stride+w*4], pixels[y*pitch:y*pitch+w*4])
+	}
 
 	return result, nil
 }
@@ -188,10 +376,32 @@ func initFlags() {
 		Default("#e9e9e9").
 		SetValue(&config.codeColor)
 
-	kingpin.Flag("bg-color", "background color, '#rgb' or '#rrggbb' or '#rrggbbaa'").
+	kingpin.Flag("bg-color", "background color, '#rgb' or '#rrggbb' or '#rrggbbaa' or 'transparent'").
 		Default("#fff").
 		SetValue(&config.bgColor)
 
+	kingpin.Flag("bg-image", "image drawn on the background color or gradient").
+		StringVar(&config.bgImage)
+
+	kingpin.Flag("bg-fit", "how the background image fills the poster").
+		Default("cover").
+		EnumVar(&config.bgFit, "cover", "contain", "stretch", "tile", "center")
+
+	kingpin.Flag("bg-opacity", "opacity of the background image, 0 ~ 1").
+		Default("1").
+		Float64Var(&config.bgOpacity)
+
+	kingpin.Flag("bg-gradient", "gradient colors of the background instead of bg-color, e.g. '#f00,#00f'").
+		SetValue(&config.bgGradient)
+
+	kingpin.Flag("bg-gradient-type", "background gradient type").
+		Default("linear").
+		EnumVar(&config.bgGradientType, "linear", "radial", "conic")
+
+	kingpin.Flag("bg-angle", "background gradient angle in degrees, 0 goes from left to right").
+		Default("0").
+		Float64Var(&config.bgAngle)
+
 	kingpin.Flag("img", fmt.Sprintf("image used to render poster (default: %s bundled in binary", defaultImage)).
 		StringVar(&config.imgPath)
 
@@ -199,10 +409,272 @@ func initFlags() {
 		Default("1,2").
 		SetValue(&config.padding)
 
-	kingpin.Arg("source", "source code path").
+	kingpin.Flag("underlay", "opacity of the image drawn faintly under the code, 0 ~ 1, 0 disables it").
+		Default("0").
+		Float64Var(&config.underlay)
+
+	kingpin.Flag("underlay-blur", "blur radius of the underlay in pixels").
+		Default("0").
+		IntVar(&config.underlayBlur)
+
+	kingpin.Flag("layout", "how characters are laid out: grid, rotated, brick, hex, spiral, circles or path").
+		Default("grid").
+		EnumVar(&config.layout, "grid", "rotated", "brick", "hex", "spiral", "circles", "path")
+
+	kingpin.Flag("layout-angle", "clockwise rotation in degrees of the rotated layout").
+		Default("45").
+		Float64Var(&config.layoutAngle)
+
+	kingpin.Flag("path", "svg file whose paths shape the path layout (default: outline of the image)").
+		StringVar(&config.path)
+
+	kingpin.Flag("bg-detect", "detect image background color from its border pixels instead of using bg-color").
+		BoolVar(&config.bgDetect)
+
+	kingpin.Flag("bg-tolerance", "max RGB distance (0 ~ 441) for an image pixel to be treated as background, alpha may differ by as much").
+		Default("0").
+		Float64Var(&config.bgTolerance)
+
+	kingpin.Flag("bg-flood", "only treat background connected to the image edges as background").
+		BoolVar(&config.bgFlood)
+
+	kingpin.Flag("alpha-mode", "how semi-transparent image pixels are handled: composite over code color, over background color, or threshold").
+		Default("code").
+		EnumVar(&config.alphaMode, "code", "bg", "threshold")
+
+	kingpin.Flag("alpha-threshold", "in threshold mode, pixels with alpha below this (0 ~ 255) use code color").
+		Default("1").
+		IntVar(&config.alphaThreshold)
+
+	kingpin.Flag("adjust", "image adjustment applied in order, can be repeated or separated by comma, e.g. contrast=1.3,gamma=0.8,invert").
+		SetValue(&config.adjustments)
+
+	kingpin.Flag("palette", "snap character colors to a palette, either colors like '#e33,#fff,#123' or a number of colors picked by k-means").
+		SetValue(&config.palette)
+
+	kingpin.Flag("dither", "dithering across cells when a palette is used").
+		Default("none").
+		EnumVar(&config.dither, "none", "ordered", "floyd-steinberg")
+
+	kingpin.Flag("mask-text", "render this text as the image instead of using img").
+		StringVar(&config.maskText)
+
+	kingpin.Flag("mask-font", "font file used to render mask text (default: same as font)").
+		StringVar(&config.maskFontPath)
+
+	kingpin.Flag("mask-color", "mask text color, several colors make a horizontal gradient, e.g. '#e33' or '#f00,#00f'").
+		Default("#000").
+		SetValue(&config.maskColors)
+
+	kingpin.Flag("shape", "generate a shape as the image instead of using img").
+		EnumVar(&config.shape, "circle", "heart", "star", "polygon", "ring")
+
+	kingpin.Flag("sides", "number of sides of polygon or points of star").
+		Default("5").
+		IntVar(&config.sides)
+
+	kingpin.Flag("fill", "shape fill color").
+		Default("#000").
+		SetValue(&config.fill)
+
+	kingpin.Flag("gradient", "gradient colors used to fill the shape, or the whole poster without a shape, e.g. '#f00,#00f'").
+		SetValue(&config.gradient)
+
+	kingpin.Flag("gradient-type", "gradient type").
+		Default("linear").
+		EnumVar(&config.gradientType, "linear", "radial", "conic")
+
+	kingpin.Flag("angle", "gradient angle in degrees, 0 goes from left to right").
+		Default("0").
+		Float64Var(&config.angle)
+
+	kingpin.Flag("coverprofile", "color code by a go test -coverprofile file").
+		StringVar(&config.coverProfile)
+
+	kingpin.Flag("covered-color", "color of covered code").
+		Default("#2ecc40").
+		SetValue(&config.coveredColor)
+
+	kingpin.Flag("uncovered-color", "color of uncovered code").
+		Default("#ff4136").
+		SetValue(&config.uncoveredColor)
+
+	kingpin.Flag("coverage-blend", "how much coverage color is mixed into image color, 0 ~ 1").
+		Default("1").
+		Float64Var(&config.coverageBlend)
+
+	kingpin.Flag("blame", "color code by git blame, age of the last change or author").
+		EnumVar(&config.blame, "age", "author")
+
+	kingpin.Flag("blame-colors", "gradient from oldest to newest change when coloring by age").
+		Default("#3b4cc0,#b40426").
+		SetValue(&config.blameColors)
+
+	kingpin.Flag("pprof", "color code by sample counts of a pprof cpu profile").
+		StringVar(&config.pprofPath)
+
+	kingpin.Flag("pprof-mode", "count samples of the running line only, or every line on the stack").
+		Default("flat").
+		EnumVar(&config.pprofMode, "flat", "cum")
+
+	kingpin.Flag("heat-colors", "gradient from coldest to hottest line").
+		Default("#ffd24d,#f03b20,#8b0000").
+		SetValue(&config.heatColors)
+
+	kingpin.Flag("colorizer", "stack of colorizers from bottom to top as name[:mode], can be repeated or separated by comma, names: image, gradient, syntax, coverage, blame, pprof, modes: layer, multiply, mask").
+		SetValue(&config.colorizers)
+
+	kingpin.Flag("plugin", "external executable which receives cells as json on stdin and returns colors and characters on stdout").
+		StringVar(&config.plugin)
+
+	kingpin.Flag("plugin-timeout", "max running time of the plugin").
+		Default("30s").
+		DurationVar(&config.pluginTimeout)
+
+	kingpin.Flag("sourcemap", "write file, line and column of every cell to this json file, or csv if it ends with .csv").
+		StringVar(&config.sourceMapPath)
+
+	kingpin.Flag("title", "title drawn in the top padding, may use template variables like {{.File}} or {{.Lines}}").
+		StringVar(&config.title)
+
+	kingpin.Flag("subtitle", "subtitle drawn under the title").
+		StringVar(&config.subtitle)
+
+	kingpin.Flag("footer", "footer drawn in the bottom padding, may use template variables like {{.GitCommit}} or {{.Date}}").
+		StringVar(&config.footer)
+
+	kingpin.Flag("caption-font", "font file of title, subtitle and footer (default: same as font)").
+		StringVar(&config.captionFont)
+
+	kingpin.Flag("title-size", "title font size").
+		Default("32").
+		IntVar(&config.titleSize)
+
+	kingpin.Flag("subtitle-size", "subtitle font size").
+		Default("18").
+		IntVar(&config.subtitleSize)
+
+	kingpin.Flag("footer-size", "footer font size").
+		Default("12").
+		IntVar(&config.footerSize)
+
+	kingpin.Flag("caption-color", "color of title, subtitle and footer").
+		Default("#555").
+		SetValue(&config.captionColor)
+
+	kingpin.Flag("caption-align", "horizontal alignment of title, subtitle and footer").
+		Default("center").
+		EnumVar(&config.captionAlign, "left", "center", "right")
+
+	kingpin.Flag("border", "border around the content area").
+		Default("none").
+		EnumVar(&config.border, "none", "solid", "double")
+
+	kingpin.Flag("border-width", "border width in characters, taken from the padding, e.g. 1 or 1,2").
+		Default("1").
+		SetValue(&config.borderWidth)
+
+	kingpin.Flag("border-color", "border color").
+		Default("#333").
+		SetValue(&config.borderColor)
+
+	kingpin.Flag("corner-radius", "radius of rounded corners of border and shadow in characters").
+		Default("0").
+		IntVar(&config.cornerRadius)
+
+	kingpin.Flag("shadow", "drop shadow offset in characters, e.g. 1 or 1,2").
+		Default("0").
+		SetValue(&config.shadow)
+
+	kingpin.Flag("shadow-color", "drop shadow color").
+		Default("#0000004d").
+		SetValue(&config.shadowColor)
+
+	kingpin.Flag("vignette", "darken the poster towards its corners, 0 ~ 1").
+		Default("0").
+		Float64Var(&config.vignette)
+
+	kingpin.Flag("code-frame", "width in characters of a frame of code characters around the content area, taken from the padding, e.g. 1 or 1,2").
+		Default("0").
+		SetValue(&config.codeFrame)
+
+	kingpin.Flag("frame-color", "color of the code frame").
+		Default("#999").
+		SetValue(&config.frameColor)
+
+	kingpin.Flag("format", "output format, html is a self-contained page showing source of the hovered character, dzi is a deep zoom tile pyramid with an offline viewer, tiff and pdf are cmyk for print").
+		Default("png").
+		EnumVar(&config.format, "png", "html", "dzi", "tiff", "pdf")
+
+	kingpin.Flag("dpi", "resolution written to png, tiff and pdf, also converts mm of bleed to pixels").
+		Default("300").
+		IntVar(&config.dpi)
+
+	kingpin.Flag("bleed", "bleed in mm added around png, tiff and pdf, background and code grid extend past the trim").
+		Default("0").
+		Float64Var(&config.bleed)
+
+	kingpin.Flag("crop-marks", "draw crop marks outside the bleed of png, tiff and pdf").
+		BoolVar(&config.cropMarks)
+
+	kingpin.Flag("cmyk-gcr", "gray component replacement of the rgb to cmyk conversion of tiff and pdf, a rough approximation without icc profiles: light, medium or heavy").
+		Default("light").
+		EnumVar(&config.cmykGCR, "light", "medium", "heavy")
+
+	kingpin.Flag("print", "also split the poster into pages of this paper size to print and assemble, a4 or letter").
+		EnumVar(&config.print, "a4", "letter")
+
+	kingpin.Flag("print-dpi", "resolution of printed pages, one poster pixel is one dot").
+		Default("150").
+		IntVar(&config.printDPI)
+
+	kingpin.Flag("print-overlap", "overlap between neighbour pages in mm").
+		Default("10").
+		Float64Var(&config.printOverlap)
+
+	kingpin.Flag("print-landscape", "use landscape pages").
+		BoolVar(&config.printLandscape)
+
+	kingpin.Flag("print-format", "pdf with all pages or a directory of png").
+		Default("pdf").
+		EnumVar(&config.printFormat, "pdf", "png")
+
+	kingpin.Flag("output", "output file, derived from source path by default").
+		Short('o').
+		StringVar(&config.output)
+
+	poster := kingpin.Command("poster", "generate a code poster").Default()
+	poster.Arg("source", "source code path, a file or a directory").
+		Required().
+		StringVar(&config.sourcePath)
+
+	postcard := kingpin.Command("postcard", "generate a double-sided 148x100mm postcard pdf, the poster on the front")
+	postcard.Arg("source", "source code path, a file or a directory").
 		Required().
 		StringVar(&config.sourcePath)
 
+	postcard.Flag("message", "message on the back, may use template variables like {{.Repo}}").
+		StringVar(&config.postcardMessage)
+
+	postcard.Flag("to", "address line on the back, can be repeated").
+		StringsVar(&config.postcardTo)
+
+	postcard.Flag("back-template", "text/template file redefining 'message', 'address' or 'caption' of the back").
+		StringVar(&config.postcardTemplate)
+
+	batch := kingpin.Command("batch", "render every job of a yaml or csv manifest with a pool of worker processes")
+	batch.Arg("jobs", "manifest, a job is a set of flags plus source").
+		Required().
+		StringVar(&config.batchPath)
+
+	batch.Flag("workers", "number of worker processes").
+		Default(strconv.Itoa(runtime.NumCPU())).
+		IntVar(&config.batchWorkers)
+
+	worker := kingpin.Command("batch-worker", "run jobs read from stdin, used by batch").Hidden()
+	worker.Flag("default-font", "font used by jobs without --font").
+		StringVar(&defaultFontPath)
+
 	kingpin.Version(appVersion)
 	kingpin.CommandLine.HelpFlag.Short('h')
 	kingpin.CommandLine.VersionFlag.Short('v')
@@ -221,21 +693,93 @@ func main() {
 		os.Exit(0)
 	}
 
-	kingpin.Parse()
+	command, err := kingpin.CommandLine.Parse(os.Args[1:])
+	if err != nil {
+		kingpin.Fatalf("%s, try --help%s", err, commandHint(os.Args[1:]))
+	}
 
-	// print config info
-	{
-		imgPath := config.imgPath
-		if imgPath == "" {
-			imgPath = fmt.Sprintf("builtin %s", defaultFont)
+	switch command {
+	case "batch":
+		if err := runBatch(); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	case "batch-worker":
+		if err := runBatchWorker(); err != nil {
+			log.Fatalln(err)
 		}
+		return
+	}
 
-		fontPath := config.fontPath
-		if fontPath == "" {
-			imgPath = fmt.Sprintf("builtin %s", defaultImage)
+	logConfig()
+
+	if _, err := runCommand(command); err != nil {
+		log.Fatalln(err)
+	} else {
+		log.Println("All done 🎉")
+	}
+}
+
+// commandHint explains how to use a source named like a command, which
+// is parsed as the command since poster became the default one
+func commandHint(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			// it does not end the command either
+			continue
+		}
+		if strings.HasPrefix(arg, "-") {
+			// skip the value of '--flag value'
+			if name := strings.TrimLeft(arg, "-"); !strings.Contains(name, "=") && takesValue(name) {
+				i++
+			}
+			continue
+		}
+
+		for _, cmd := range kingpin.CommandLine.Model().Commands {
+			if cmd.Name == arg && fileExists(arg) {
+				return fmt.Sprintf("\n'%s' is the %s command, to use the file as source run 'codeposter poster -- %s'", arg, arg, arg)
+			}
 		}
+		return ""
+	}
 
-		log.Printf(`Config:
+	return ""
+}
+
+// takesValue reports whether a global flag, by long or short name, has
+// a value
+func takesValue(name string) bool {
+	for _, flag := range kingpin.CommandLine.Model().Flags {
+		if flag.Name == name || (len(name) == 1 && flag.Short == rune(name[0])) {
+			return !flag.IsBoolFlag()
+		}
+	}
+	return false
+}
+
+// runCommand runs poster or postcard and returns the output path
+func runCommand(command string) (string, error) {
+	if command == "postcard" {
+		return runPostcard()
+	}
+
+	return run()
+}
+
+func logConfig() {
+	imgPath := config.imgPath
+	if imgPath == "" {
+		imgPath = fmt.Sprintf("builtin %s", defaultFont)
+	}
+
+	fontPath := config.fontPath
+	if fontPath == "" {
+		imgPath = fmt.Sprintf("builtin %s", defaultImage)
+	}
+
+	log.Printf(`Config:
   source path: %s
   img path: %s
   font path: %s
@@ -245,44 +789,144 @@ func main() {
   width in characters: %d
   height in characters: %d
   padding in characters: %s
+  layout: %s
+  detect image background: %t
+  background tolerance: %.1f
+  background flood fill: %t
+  alpha mode: %s
+  image adjustments: %s
+  palette: %s
+  dither: %s
+  mask text: %s
+  shape: %s
+  gradient: %s
+  cover profile: %s
+  blame: %s
+  pprof: %s
+  colorizers: %s
+  plugin: %s
+  title: %s
+  format: %s
+  dpi: %d
+  bleed: %.1fmm
+  crop marks: %t
+  print: %s
 `, config.sourcePath,
-			imgPath,
-			fontPath,
-			config.fontSize,
-			config.bgColor.String(),
-			config.codeColor.String(),
-			config.width,
-			config.height,
-			config.padding.String(),
-		)
-	}
-
-	if err := run(); err != nil {
-		log.Fatalln(err)
-	} else {
-		log.Println("All done 🎉")
-	}
+		imgPath,
+		fontPath,
+		config.fontSize,
+		config.bgColor.String(),
+		config.codeColor.String(),
+		config.width,
+		config.height,
+		config.padding.String(),
+		config.layout,
+		config.bgDetect,
+		config.bgTolerance,
+		config.bgFlood,
+		config.alphaMode,
+		config.adjustments.String(),
+		config.palette.String(),
+		config.dither,
+		config.maskText,
+		config.shape,
+		config.gradient.String(),
+		config.coverProfile,
+		config.blame,
+		config.pprofPath,
+		config.colorizers.String(),
+		config.plugin,
+		config.title,
+		config.format,
+		config.dpi,
+		config.bleed,
+		config.cropMarks,
+		config.print,
+	)
 }
 
-func readCode() ([]byte, error) {
-	content, err := ioutil.ReadFile(config.sourcePath)
+// sourceChar is a character of the poster along with where it comes from
+type sourceChar struct {
+	char byte
+	file string
+	line int // starts from 1
+	col  int // in bytes, starts from 1
+}
+
+// sourceFiles returns the source path itself, or regular files in it
+// when it is a directory
+func sourceFiles() ([]string, error) {
+	info, err := os.Stat(config.sourcePath)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not read source code")
 	}
 
-	// only keep ascii characters and remove whitespaces
-	var buf bytes.Buffer
+	if !info.IsDir() {
+		return []string{config.sourcePath}, nil
+	}
+
+	entries, err := ioutil.ReadDir(config.sourcePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read source directory")
+	}
+
+	var result []string
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			result = append(result, filepath.Join(config.sourcePath, entry.Name()))
+		}
+	}
+
+	return result, nil
+}
+
+func readCode() ([]sourceChar, error) {
+	files, err := sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []sourceChar
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read source code")
+		}
+
+		line, col := 1, 1
 
-	for _, b := range content {
-		if b >= 0x20 && b <= 0x7e && b != ' ' && b != '\t' && b != '\n' {
-			buf.WriteByte(b)
+		// only keep ascii characters and remove whitespaces
+		for _, b := range content {
+			if b >= 0x20 && b <= 0x7e && b != ' ' && b != '\t' && b != '\n' {
+				result = append(result, sourceChar{char: b, file: file, line: line, col: col})
+			}
+
+			if b == '\n' {
+				line++
+				col = 1
+			} else {
+				col++
+			}
 		}
 	}
 
-	return buf.Bytes(), nil
+	return result, nil
 }
 
 func openAndResizeImage(contentWidth, contentHeight int) (image.Image, error) {
+	if config.maskText != "" {
+		img, err := renderMaskText(contentWidth, contentHeight)
+		if err != nil {
+			return nil, err
+		}
+		return config.adjustments.apply(img), nil
+	}
+
+	if config.shape != "" || len(config.gradient) > 0 {
+		return config.adjustments.apply(generateImage(contentWidth, contentHeight)), nil
+	}
+
 	var imgReader io.Reader
 
 	if config.imgPath == "" {
@@ -317,40 +961,37 @@ func openAndResizeImage(contentWidth, contentHeight int) (image.Image, error) {
 		}
 	}
 
-	return img, nil
+	return config.adjustments.apply(img), nil
 }
 
-func initSDLAndTTF() (*sdlContext, error) {
-	// init sdl
-	if err := sdl.Init(sdl.INIT_VIDEO); err != nil {
-		return nil, errors.Wrap(err, "could not init sdl")
-	}
+func initSDLAndTTF(fontSize int) (*sdlContext, error) {
+	// sdl, ttf and default font are initialized once for all jobs of a batch
+	if !sdlInitialized {
+		// init sdl
+		if err := sdl.Init(sdl.INIT_VIDEO); err != nil {
+			return nil, errors.Wrap(err, "could not init sdl")
+		}
+
+		// init ttf
+		if err := ttf.Init(); err != nil {
+			return nil, errors.Wrap(err, "could not init sdl ttf")
+		}
 
-	// init ttf
-	if err := ttf.Init(); err != nil {
-		return nil, errors.Wrap(err, "could not init sdl ttf")
+		sdlInitialized = true
 	}
 
 	// load default font
 	if config.fontPath == "" {
-		tmpFile, err := ioutil.TempFile("", "codeposter")
-		if err != nil {
-			return nil, errors.Wrap(err, "couldn't create temporary file")
+		if err := extractDefaultFont(); err != nil {
+			return nil, err
 		}
-
-		config.fontPath = tmpFile.Name()
-		buf, _ := Asset(defaultFont)
-		if _, err := tmpFile.Write(buf); err != nil {
-			return nil, errors.Wrap(err, "could not write to temporary file")
-		}
-
-		tmpFile.Close()
+		config.fontPath = defaultFontPath
 	}
 
 	// open font
-	font, err := ttf.OpenFont(config.fontPath, config.fontSize)
+	font, err := openFont(config.fontPath, fontSize)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not open font")
+		return nil, err
 	}
 
 	charWidth, charHeight, err := font.SizeUTF8("a")
@@ -364,146 +1005,285 @@ func initSDLAndTTF() (*sdlContext, error) {
 	winWidth := contentWidth + config.padding.horizontal*2*charWidth
 	winHeight := contentHeight + config.padding.vertical*2*charHeight
 
-	win, err := sdl.CreateWindow("", 0, 0, int32(winWidth), int32(winHeight), sdl.WINDOW_HIDDEN)
-	if err != nil {
-		return nil, errors.Wrap(err, "could not create sdl window")
-	}
-
-	winSurface, err := win.GetSurface()
-	if err != nil {
-		return nil, errors.Wrap(err, "could not get surface of window")
-	}
-
-	renderer, err := sdl.CreateSoftwareRenderer(winSurface)
-	if err != nil {
-		return nil, errors.Wrap(err, "could not create renderer from window surface")
-	}
-
+	// no window surface is created, posters are rendered in pieces
+	// by regionRenderer so their pixels are never held in memory at once
 	return &sdlContext{
-		win:           win,
-		renderer:      renderer,
 		charWidth:     charWidth,
 		charHeight:    charHeight,
 		winWidth:      winWidth,
 		winHeight:     winHeight,
 		contentWidth:  contentWidth,
 		contentHeight: contentHeight,
-		winSurface:    winSurface,
 		font:          font,
+		scale:         float64(fontSize) / float64(config.fontSize),
 	}, nil
 }
 
-// x, y are in pixels
-func getColor(img image.Image, winWidth, winHeight, x, y int) sdl.Color {
+// x, y are in pixels, transparent is returned where the image has
+// no color so that other colorizers or code color show through
+func getColor(src *sourceImage, winWidth, winHeight, x, y int) sdl.Color {
+	img := src.img
+
 	// coordinates relative to image
 	imgX := x - (winWidth-img.Bounds().Max.X)/2
 	imgY := y - (winHeight-img.Bounds().Max.Y)/2
 
-	codeColor := sdl.Color(config.codeColor)
-
 	// outside of image
 	if imgX < 0 || imgX >= img.Bounds().Max.X {
-		return codeColor
+		return sdl.Color{}
 	}
 
 	if imgY < 0 || imgY >= img.Bounds().Max.Y {
-		return codeColor
+		return sdl.Color{}
 	}
 
-	color := img.At(imgX, imgY)
-	r, g, b, a := color.RGBA()
+	result := pixelColor(img, imgX, imgY)
 
 	// full transparent
-	if a == 0 {
-		return codeColor
+	if result.A == 0 {
+		return sdl.Color{}
+	}
+
+	if src.isBackground(imgX, imgY, result) {
+		return sdl.Color{}
 	}
 
-	result := sdl.Color{
-		R: uint8((float32)(r) / 0xffff * 0xff),
-		G: uint8(float32(g) / 0xffff * 0xff),
-		B: uint8(float32(b) / 0xffff * 0xff),
-		A: uint8(float32(a) / 0xffff * 0xff),
+	return compositeAlpha(result, src.posterBg(imgX, imgY))
+}
+
+// compositeAlpha blends a semi-transparent image color over the color
+// selected by alpha mode, bg is the poster background under the pixel,
+// the result is opaque unless the background is not
+func compositeAlpha(c, bg sdl.Color) sdl.Color {
+	switch config.alphaMode {
+	case "threshold":
+		if int(c.A) < config.alphaThreshold {
+			return sdl.Color{}
+		}
+		c.A = 0xff
+		return c
+	case "bg":
+		return sdl.Color(colorize.Over(imgcolor.NRGBA(c), imgcolor.NRGBA(bg)))
 	}
 
-	if result == sdl.Color(config.bgColor) {
-		result = codeColor
+	under := sdl.Color(config.codeColor)
+
+	a := float64(c.A) / 0xff
+	blend := func(top, bottom uint8) uint8 {
+		return uint8(float64(top)*a + float64(bottom)*(1-a) + 0.5)
 	}
 
-	return result
+	return sdl.Color{
+		R: blend(c.R, under.R),
+		G: blend(c.G, under.G),
+		B: blend(c.B, under.B),
+		A: 0xff,
+	}
+}
+
+// poster is a code poster ready to be written in any format
+type poster struct {
+	ctx      *sdlContext
+	code     []sourceChar
+	cells    []Cell
+	colors   []sdl.Color
+	legend   []legendEntry
+	captions []caption
+	texts    []textItem // drawn on top of cells, captions and legend
 }
 
-func run() error {
+// buildPoster lays out and colors the poster with characters of
+// fontSize, which is --font-size unless it is fitted to a postcard
+func buildPoster(fontSize int) (*poster, error) {
 	// init sdl
-	sdlContext, err := initSDLAndTTF()
+	sdlContext, err := initSDLAndTTF(fontSize)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if err := checkBackground(); err != nil {
+		return nil, err
+	}
+
+	if err := checkDecorations(); err != nil {
+		return nil, err
+	}
+
+	if err := checkUnderlay(); err != nil {
+		return nil, err
+	}
+
+	if err := checkLayout(); err != nil {
+		return nil, err
 	}
 
 	// read code
 	code, err := readCode()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(code) == 0 {
-		return errors.New("there is no valid characters in the source code (visible ascii characters)")
+		return nil, errors.New("there is no valid characters in the source code (visible ascii characters)")
 	}
 
 	// open and resize image
 	img, err := openAndResizeImage(int(sdlContext.contentWidth), int(sdlContext.contentHeight))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	sdlContext.background, err = newBackground(sdlContext)
+	if err != nil {
+		return nil, err
 	}
+	// the image is centered in the poster
+	at := image.Pt((sdlContext.winWidth-img.Bounds().Max.X)/2, (sdlContext.winHeight-img.Bounds().Max.Y)/2)
+	src := newSourceImage(img, sdlContext.background, at)
+	sdlContext.underlay = newUnderlay(src, int(math.Round(float64(config.underlayBlur)*sdlContext.scale)))
 
-	// poll sdl events
-	for sdl.PollEvent() != nil {
+	colorizer, legend, err := buildColorizer(src, sdlContext)
+	if err != nil {
+		return nil, err
 	}
 
-	// render
-	sdlContext.renderer.SetDrawColor(config.bgColor.R, config.bgColor.G, config.bgColor.B, config.bgColor.A)
-	sdlContext.renderer.Clear()
-	var dstRect sdl.Rect
-	for cy := 0; cy < config.height; cy++ {
-		for cx := 0; cx < config.width; cx++ {
-			index := (cy*config.width + cx) % len(code)
-			char := code[index]
-			x := (cx + config.padding.horizontal) * int(sdlContext.charWidth)
-			y := (cy + config.padding.vertical) * int(sdlContext.charHeight)
+	// compute colors
+	sdlContext.layout = newLayout(sdlContext, src)
+	cells, err := sdlContext.layout.Cells()
+	if err != nil {
+		return nil, err
+	}
+	if len(cells) == 0 {
+		return nil, errors.Errorf("%s layout has no room for any character", config.layout)
+	}
 
-			centerX := x + (int)(sdlContext.charWidth)/2
-			centerY := y + (int)(sdlContext.charHeight)/2
-			color := getColor(img, int(sdlContext.winWidth), int(sdlContext.winHeight), centerX, centerY)
+	colors := make([]sdl.Color, len(cells))
+	for i := range cells {
+		setChar(&cells[i], code[i%len(code)])
+		colors[i] = sdl.Color(colorizer.Color(cells[i]))
+	}
 
-			t, err := renderChar(sdlContext.font, sdlContext.renderer, char, color)
+	if config.plugin != "" {
+		if err := runPlugin(sdlContext, cells, colors); err != nil {
+			return nil, err
+		}
+	}
 
-			if err != nil {
-				return errors.Wrap(err, "could not render string in sdl ttf")
-			}
+	if !config.palette.empty() {
+		config.palette.quantize(colors, cells, config.dither)
+	}
 
-			dstRect.X = int32(x)
-			dstRect.Y = int32(y)
-			dstRect.W = t.w
-			dstRect.H = t.h
+	captions, legendY, err := layoutCaptions(sdlContext, code, legend != nil)
+	if err != nil {
+		return nil, err
+	}
 
-			if err := sdlContext.renderer.Copy(t.texture, nil, &dstRect); err != nil {
-				return errors.Wrap(err, "sdl renderer failed")
-			}
+	var texts []textItem
+	for _, c := range captions {
+		texts = append(texts, c.textItem)
+	}
+
+	if legend != nil {
+		items, err := legendItems(sdlContext, legend, legendY)
+		if err != nil {
+			return nil, err
 		}
+		texts = append(texts, items...)
+	}
+
+	return &poster{sdlContext, code, cells, colors, legend, captions, texts}, nil
+}
+
+func runPostcard() (string, error) {
+	fontSize, err := postcardFontSize()
+	if err != nil {
+		return "", err
+	}
+
+	p, err := buildPoster(fontSize)
+	if err != nil {
+		return "", err
+	}
+
+	outputName, err := writePostcard(p)
+	if err != nil {
+		return "", err
 	}
 
+	log.Printf("postcard generated: %s\n", outputName)
+
+	return outputName, nil
+}
+
+func run() (string, error) {
+	p, err := buildPoster(config.fontSize)
+	if err != nil {
+		return "", err
+	}
+	sdlContext, cells, colors, texts := p.ctx, p.cells, p.colors, p.texts
+
 	// output
-	sourceBase := path.Base(config.sourcePath)
-	outputName := sourceBase + ".png"
-	for i := 1; fileExists(outputName); i++ {
-		outputName = fmt.Sprintf("%s.%d.png", sourceBase, i)
+	outputName := config.output
+	if outputName == "" {
+		outputName = outputPath(config.format)
 	}
 
-	if err := sdlimg.SavePNG(sdlContext.winSurface, outputName); err != nil {
-		return errors.Wrap(err, "could not save png of sdl surface")
+	switch config.format {
+	case "html":
+		if err := writeHTML(outputName, sdlContext, cells, colors, p.legend, p.captions); err != nil {
+			return "", err
+		}
+	case "dzi":
+		if err := writeDZI(outputName, sdlContext, cells, colors, texts); err != nil {
+			return "", err
+		}
+	case "tiff":
+		if err := writeTIFF(outputName, sdlContext, cells, colors, texts); err != nil {
+			return "", err
+		}
+	case "pdf":
+		if err := writePDF(outputName, sdlContext, cells, colors, texts); err != nil {
+			return "", err
+		}
+	default:
+		if err := writePNG(outputName, sdlContext, cells, colors, texts); err != nil {
+			return "", err
+		}
 	}
 
 	log.Printf("code poster generated: %s\n", outputName)
 
-	return nil
+	if config.sourceMapPath != "" {
+		if err := writeSourceMap(config.sourceMapPath, sdlContext, cells, outputName); err != nil {
+			return "", err
+		}
+		log.Printf("source map generated: %s\n", config.sourceMapPath)
+	}
+
+	if config.print != "" {
+		printName, err := writePrintPages(outputName, sdlContext, cells, colors, texts)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("print pages generated: %s\n", printName)
+	}
+
+	return outputName, nil
+}
+
+// outputPath returns a file name which does not exist yet,
+// e.g. 'main.go.png', 'main.go.1.png'
+func outputPath(ext string) string {
+	return uniqueOutputPath(path.Base(config.sourcePath), ext, nil)
+}
+
+// uniqueOutputPath returns base.ext, or base.N.ext when it exists or
+// is taken
+func uniqueOutputPath(base, ext string, taken map[string]int) string {
+	result := base + "." + ext
+	for i := 1; fileExists(result) || taken[result] != 0; i++ {
+		result = fmt.Sprintf("%s.%d.%s", base, i, ext)
+	}
+
+	return result
 }
 
 func fileExists(path string) bool {
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+func TestColorSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  sdl.Color
+		ok    bool
+	}{
+		{"#fff", sdl.Color{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, true},
+		{"#1a2", sdl.Color{R: 0x11, G: 0xaa, B: 0x22, A: 0xff}, true},
+		{"#12AbEf", sdl.Color{R: 0x12, G: 0xab, B: 0xef, A: 0xff}, true},
+		{"#12345678", sdl.Color{R: 0x12, G: 0x34, B: 0x56, A: 0x78}, true},
+		{"transparent", sdl.Color{}, true},
+		{"fff", sdl.Color{}, false},
+		{"#ffff", sdl.Color{}, false},
+		{"#1234567", sdl.Color{}, false},
+		{"#ggg", sdl.Color{}, false},
+		{"", sdl.Color{}, false},
+	}
+
+	for _, test := range tests {
+		var c color
+		err := c.Set(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("Set(%q) error %v, want ok %t", test.value, err, test.ok)
+			continue
+		}
+		if test.ok && sdl.Color(c) != test.want {
+			t.Errorf("Set(%q) = %v, want %v", test.value, sdl.Color(c), test.want)
+		}
+	}
+}
+
+func TestColorListSet(t *testing.T) {
+	var l colorList
+	if err := l.Set("#f00, #00ff00,#0000ff80"); err != nil {
+		t.Fatal(err)
+	}
+	want := colorList{{R: 0xff, A: 0xff}, {G: 0xff, A: 0xff}, {B: 0xff, A: 0x80}}
+	if len(l) != len(want) {
+		t.Fatalf("got %v, want %v", l, want)
+	}
+	for i := range want {
+		if l[i] != want[i] {
+			t.Errorf("color %d is %v, want %v", i, l[i], want[i])
+		}
+	}
+
+	if err := l.Set("#f00,nope"); err == nil {
+		t.Error("invalid color in the list should fail")
+	}
+}
+
+func TestPaddingSet(t *testing.T) {
+	tests := []struct {
+		value                string
+		vertical, horizontal int
+		ok                   bool
+	}{
+		{"2", 2, 2, true},
+		{"1,3", 1, 3, true},
+		{"0", 0, 0, true},
+		{"1,2,3", 0, 0, false},
+		{"a", 0, 0, false},
+		{"1,", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		var p padding
+		err := p.Set(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("Set(%q) error %v, want ok %t", test.value, err, test.ok)
+			continue
+		}
+		if test.ok && (p.vertical != test.vertical || p.horizontal != test.horizontal) {
+			t.Errorf("Set(%q) = %d,%d, want %d,%d", test.value, p.vertical, p.horizontal, test.vertical, test.horizontal)
+		}
+	}
+}
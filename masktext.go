@@ -0,0 +1,102 @@
+package main
+
+import (
+	"image"
+
+	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+	"github.com/veandco/go-sdl2/ttf"
+)
+
+// text is rendered at this size and then scaled to fit the poster
+const maskFontSize = 256
+
+// renderMaskText renders config.maskText into an image which fits
+// the content area, transparent pixels fall back to code color
+func renderMaskText(contentWidth, contentHeight int) (image.Image, error) {
+	fontPath := config.maskFontPath
+	if fontPath == "" {
+		fontPath = config.fontPath
+	}
+
+	font, err := ttf.OpenFont(fontPath, maskFontSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open mask font")
+	}
+	defer font.Close()
+
+	surface, err := font.RenderUTF8Blended(config.maskText, sdl.Color{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not render mask text")
+	}
+	defer surface.Free()
+
+	glyphs, err := surfaceToImage(surface)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop the empty space of line height
+	bounds := opaqueBounds(glyphs)
+	if bounds.Empty() {
+		return nil, errors.New("mask text has no visible characters")
+	}
+	img := fitImage(glyphs.SubImage(bounds), contentWidth, contentHeight)
+
+	return colorizeMask(img, config.maskColors), nil
+}
+
+// opaqueBounds is the smallest rectangle containing all non transparent pixels
+func opaqueBounds(img *image.NRGBA) image.Rectangle {
+	var result image.Rectangle
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if img.Pix[img.PixOffset(x, y)+3] == 0 {
+				continue
+			}
+			result = result.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+
+	return result
+}
+
+// fitImage scales img up or down to fit in width x height keeping aspect ratio
+func fitImage(img image.Image, width, height int) image.Image {
+	imgRatio := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
+	winRatio := float64(width) / float64(height)
+
+	if imgRatio > winRatio {
+		return resize.Resize(uint(width), 0, img, resize.Lanczos3)
+	}
+
+	return resize.Resize(0, uint(height), img, resize.Lanczos3)
+}
+
+// colorizeMask keeps alpha of the mask and paints it with colors,
+// several colors make a gradient from left to right
+func colorizeMask(mask image.Image, colors []sdl.Color) *image.NRGBA {
+	src := toNRGBA(mask)
+	w := src.Bounds().Dx()
+
+	for x := 0; x < w; x++ {
+		t := 0.0
+		if w > 1 {
+			t = float64(x) / float64(w-1)
+		}
+		c := gradientAt(colors, t)
+
+		for y := 0; y < src.Bounds().Dy(); y++ {
+			i := src.PixOffset(x, y)
+			src.Pix[i] = c.R
+			src.Pix[i+1] = c.G
+			src.Pix[i+2] = c.B
+			src.Pix[i+3] = uint8(uint16(src.Pix[i+3]) * uint16(c.A) / 0xff)
+		}
+	}
+
+	return src
+}
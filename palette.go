@@ -0,0 +1,250 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// palette is either a fixed list of colors or the number of colors
+// to pick from the poster with k-means
+type palette struct {
+	colors colorList
+	size   int
+}
+
+func (p *palette) Set(value string) error {
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 1 {
+			return errors.New("palette size should be at least 1")
+		}
+		p.colors = nil
+		p.size = n
+		return nil
+	}
+
+	p.size = 0
+	return p.colors.Set(value)
+}
+
+func (p *palette) String() string {
+	if p.size > 0 {
+		return strconv.Itoa(p.size)
+	}
+
+	return p.colors.String()
+}
+
+func (p *palette) empty() bool {
+	return p.size == 0 && len(p.colors) == 0
+}
+
+// quantize snaps the colors of cells to the palette, dithering follows
+// the rows and columns of the cells
+func (p *palette) quantize(colors []sdl.Color, cells []Cell, dither string) {
+	entries := []sdl.Color(p.colors)
+	if p.size > 0 {
+		entries = kmeans(colors, p.size)
+	}
+
+	switch dither {
+	case "ordered":
+		orderedDither(colors, cells, entries)
+	case "floyd-steinberg":
+		floydSteinberg(colors, cells, entries)
+	default:
+		for i, c := range colors {
+			colors[i] = nearestColor(entries, c)
+		}
+	}
+}
+
+func nearestColor(entries []sdl.Color, c sdl.Color) sdl.Color {
+	best := entries[0]
+	bestDist := math.Inf(1)
+
+	for _, e := range entries {
+		if d := colorDistance(e, c); d < bestDist {
+			best, bestDist = e, d
+		}
+	}
+
+	return best
+}
+
+var bayer4 = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+func orderedDither(colors []sdl.Color, cells []Cell, entries []sdl.Color) {
+	// roughly the distance between neighbouring palette colors
+	spread := 0xff / math.Cbrt(float64(len(entries)))
+
+	for i, c := range colors {
+		cx, cy := mod(cells[i].GridX, 4), mod(cells[i].GridY, 4)
+		offset := (bayer4[cy][cx]/16 - 0.5) * spread
+
+		shifted := sdl.Color{
+			R: clamp8(float64(c.R) + offset),
+			G: clamp8(float64(c.G) + offset),
+			B: clamp8(float64(c.B) + offset),
+			A: c.A,
+		}
+		colors[i] = nearestColor(entries, shifted)
+	}
+}
+
+// floydSteinberg walks cells row by row, rows of other layouts than
+// grid may differ in length, error only goes to cells which exist
+func floydSteinberg(colors []sdl.Color, cells []Cell, entries []sdl.Color) {
+	buf := make([][3]float64, len(colors))
+	for i, c := range colors {
+		buf[i] = [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+	}
+
+	index := make(map[[2]int]int, len(cells))
+	order := make([]int, len(cells))
+	for i, cell := range cells {
+		index[[2]int{cell.GridX, cell.GridY}] = i
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ca, cb := cells[order[a]], cells[order[b]]
+		if ca.GridY != cb.GridY {
+			return ca.GridY < cb.GridY
+		}
+		return ca.GridX < cb.GridX
+	})
+
+	spread := func(x, y int, e [3]float64, weight float64) {
+		i, ok := index[[2]int{x, y}]
+		if !ok {
+			return
+		}
+		for ch := range e {
+			buf[i][ch] += e[ch] * weight
+		}
+	}
+
+	for _, i := range order {
+		x, y := cells[i].GridX, cells[i].GridY
+		old := buf[i]
+		c := nearestColor(entries, sdl.Color{
+			R: clamp8(old[0]),
+			G: clamp8(old[1]),
+			B: clamp8(old[2]),
+		})
+		c.A = colors[i].A
+		colors[i] = c
+
+		e := [3]float64{old[0] - float64(c.R), old[1] - float64(c.G), old[2] - float64(c.B)}
+		spread(x+1, y, e, 7.0/16)
+		spread(x-1, y+1, e, 3.0/16)
+		spread(x, y+1, e, 5.0/16)
+		spread(x+1, y+1, e, 1.0/16)
+	}
+}
+
+// kmeans picks k representative colors, seeded deterministically
+// so the same input always gives the same poster
+func kmeans(colors []sdl.Color, k int) []sdl.Color {
+	// work on unique colors weighted by count
+	counts := make(map[sdl.Color]int)
+	for _, c := range colors {
+		c.A = 0xff
+		counts[c]++
+	}
+
+	points := make([]sdl.Color, 0, len(counts))
+	for c := range counts {
+		points = append(points, c)
+	}
+	sortColors(points)
+
+	if len(points) <= k {
+		return points
+	}
+
+	// k-means++ initialization
+	rnd := rand.New(rand.NewSource(1))
+	centers := []sdl.Color{points[rnd.Intn(len(points))]}
+	dists := make([]float64, len(points))
+
+	for len(centers) < k {
+		var total float64
+		for i, p := range points {
+			d := colorDistance(p, nearestColor(centers, p))
+			dists[i] = d * d * float64(counts[p])
+			total += dists[i]
+		}
+
+		target := rnd.Float64() * total
+		next := points[len(points)-1]
+		for i, d := range dists {
+			target -= d
+			if target <= 0 {
+				next = points[i]
+				break
+			}
+		}
+		centers = append(centers, next)
+	}
+
+	for iter := 0; iter < 20; iter++ {
+		sums := make([][4]float64, k)
+		for _, p := range points {
+			best, bestDist := 0, math.Inf(1)
+			for j, c := range centers {
+				if d := colorDistance(p, c); d < bestDist {
+					best, bestDist = j, d
+				}
+			}
+
+			w := float64(counts[p])
+			sums[best][0] += float64(p.R) * w
+			sums[best][1] += float64(p.G) * w
+			sums[best][2] += float64(p.B) * w
+			sums[best][3] += w
+		}
+
+		changed := false
+		for j, sum := range sums {
+			if sum[3] == 0 {
+				continue
+			}
+			c := sdl.Color{
+				R: clamp8(sum[0] / sum[3]),
+				G: clamp8(sum[1] / sum[3]),
+				B: clamp8(sum[2] / sum[3]),
+				A: 0xff,
+			}
+			if c != centers[j] {
+				centers[j] = c
+				changed = true
+			}
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	return centers
+}
+
+func sortColors(colors []sdl.Color) {
+	key := func(c sdl.Color) uint32 {
+		return uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+	}
+
+	sort.Slice(colors, func(i, j int) bool {
+		return key(colors[i]) < key(colors[j])
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const pointsPerMM = 72 / 25.4
+
+// pdfWriter writes a pdf whose pages are full page images, pages are
+// written as soon as they are added so only one is held in memory
+type pdfWriter struct {
+	w       io.Writer
+	offset  int
+	offsets []int // by object number - 1
+	pages   []int // object numbers
+}
+
+// object 1 is the catalog and 2 the page tree, both written by close
+func newPDFWriter(w io.Writer) (*pdfWriter, error) {
+	p := &pdfWriter{w: w, offsets: make([]int, 2)}
+
+	if err := p.write("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *pdfWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.offset += n
+	if err != nil {
+		return n, errors.Wrap(err, "could not write pdf")
+	}
+
+	return n, nil
+}
+
+func (p *pdfWriter) write(s string) error {
+	_, err := p.Write([]byte(s))
+	return err
+}
+
+func (p *pdfWriter) newObject() int {
+	p.offsets = append(p.offsets, 0)
+	return len(p.offsets)
+}
+
+func (p *pdfWriter) writeObject(n int, dict string, stream []byte) error {
+	p.offsets[n-1] = p.offset
+
+	if stream == nil {
+		return p.write(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", n, dict))
+	}
+
+	if err := p.write(fmt.Sprintf("%d 0 obj\n%s\nstream\n", n, dict)); err != nil {
+		return err
+	}
+	if err := p.write(string(stream)); err != nil {
+		return err
+	}
+
+	return p.write("\nendstream\nendobj\n")
+}
+
+// addImagePage adds a page of width x height in mm covered by img,
+// transparent pixels are flattened onto white paper
+func (p *pdfWriter) addImagePage(img image.Image, width, height float64) error {
+	bounds := img.Bounds()
+
+	page := pdfPage{
+		pixelsWide: bounds.Dx(),
+		pixelsHigh: bounds.Dy(),
+		colorSpace: "/DeviceRGB",
+		width:      width,
+		height:     height,
+	}
+
+	return p.addPage(page, func(w io.Writer) error {
+		row := make([]byte, 0, bounds.Dx()*3)
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row = row[:0]
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, a := img.At(x, y).RGBA()
+				white := 0xffff - a
+				row = append(row, uint8((r+white)>>8), uint8((g+white)>>8), uint8((b+white)>>8))
+			}
+
+			if _, err := w.Write(row); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// pdfPage is a page covered by one image
+type pdfPage struct {
+	pixelsWide int
+	pixelsHigh int
+	colorSpace string  // e.g. '/DeviceRGB'
+	width      float64 // mm
+	height     float64 // mm
+	trim       float64 // mm cut off every side after printing, 0 if none
+	bleed      float64 // mm of trim which is bleed, the rest is for marks
+}
+
+// addPage adds page, writeRows writes samples of its image top to bottom
+// and they are compressed on the fly so the image is never held in memory
+func (p *pdfWriter) addPage(page pdfPage, writeRows func(w io.Writer) error) error {
+	w, h := page.width*pointsPerMM, page.height*pointsPerMM
+	imageObj, lengthObj, contentObj, pageObj := p.newObject(), p.newObject(), p.newObject(), p.newObject()
+
+	p.offsets[imageObj-1] = p.offset
+	err := p.write(fmt.Sprintf(
+		"%d 0 obj\n<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /FlateDecode /Length %d 0 R >>\nstream\n",
+		imageObj, page.pixelsWide, page.pixelsHigh, page.colorSpace, lengthObj,
+	))
+	if err != nil {
+		return err
+	}
+
+	start := p.offset
+	zw := zlib.NewWriter(p)
+	if err := writeRows(zw); err != nil {
+		return errors.Wrap(err, "could not write pdf image")
+	}
+	if err := zw.Close(); err != nil {
+		return errors.Wrap(err, "could not write pdf image")
+	}
+	length := p.offset - start
+
+	if err := p.write("\nendstream\nendobj\n"); err != nil {
+		return err
+	}
+
+	if err := p.writeObject(lengthObj, fmt.Sprint(length), nil); err != nil {
+		return err
+	}
+
+	content := []byte(fmt.Sprintf("q %.3f 0 0 %.3f 0 0 cm /Im0 Do Q", w, h))
+	err = p.writeObject(contentObj, fmt.Sprintf("<< /Length %d >>", len(content)), content)
+	if err != nil {
+		return err
+	}
+
+	var boxes string
+	if page.trim > 0 {
+		box := func(name string, inset float64) string {
+			inset *= pointsPerMM
+			return fmt.Sprintf(" /%s [%.3f %.3f %.3f %.3f]", name, inset, inset, w-inset, h-inset)
+		}
+		boxes = box("TrimBox", page.trim) + box("BleedBox", page.trim-page.bleed)
+	}
+
+	err = p.writeObject(pageObj, fmt.Sprintf(
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.3f %.3f]%s /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+		w, h, boxes, imageObj, contentObj,
+	), nil)
+	if err != nil {
+		return err
+	}
+
+	p.pages = append(p.pages, pageObj)
+
+	return nil
+}
+
+// close writes page tree, catalog and cross reference table
+func (p *pdfWriter) close() error {
+	var kids []string
+	for _, page := range p.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+
+	err := p.writeObject(2, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)), nil)
+	if err != nil {
+		return err
+	}
+
+	if err := p.writeObject(1, "<< /Type /Catalog /Pages 2 0 R >>", nil); err != nil {
+		return err
+	}
+
+	xref := p.offset
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, offset := range p.offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, xref)
+
+	return p.write(buf.String())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// pluginRequest is written to stdin of the plugin
+type pluginRequest struct {
+	Layout     string       `json:"layout"`
+	Width      int          `json:"width"`  // in chars, the longest row
+	Height     int          `json:"height"` // in chars, number of rows
+	CharWidth  int          `json:"charWidth"`
+	CharHeight int          `json:"charHeight"`
+	Cells      []pluginCell `json:"cells"` // row by row, or line by line for non-grid layouts
+}
+
+// x and y of cells of the spiral, circles and path layouts are the
+// index in the line and the line
+type pluginCell struct {
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	PixelX int    `json:"pixelX"`
+	PixelY int    `json:"pixelY"`
+	Char   string `json:"char"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Color  string `json:"color"` // '#rrggbbaa' computed by colorizers
+}
+
+// pluginResponse is read from stdout of the plugin, both fields are
+// optional, an empty color keeps the computed one
+type pluginResponse struct {
+	Colors []string `json:"colors"`
+	Chars  string   `json:"chars"`
+	Error  string   `json:"error"`
+}
+
+// runPlugin lets config.plugin replace colors and characters of cells
+func runPlugin(ctx *sdlContext, cells []Cell, colors []sdl.Color) error {
+	width, height := gridSize(cells)
+	req := pluginRequest{
+		Layout:     config.layout,
+		Width:      width,
+		Height:     height,
+		CharWidth:  ctx.charWidth,
+		CharHeight: ctx.charHeight,
+		Cells:      make([]pluginCell, len(cells)),
+	}
+
+	for i, cell := range cells {
+		c := colors[i]
+		req.Cells[i] = pluginCell{
+			X:      cell.GridX,
+			Y:      cell.GridY,
+			PixelX: cell.PixelX,
+			PixelY: cell.PixelY,
+			Char:   string(cell.Char),
+			File:   cell.File,
+			Line:   cell.Line,
+			Column: cell.Column,
+			Color:  fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A),
+		}
+	}
+
+	input, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "could not encode plugin request")
+	}
+
+	timeout, cancel := context.WithTimeout(context.Background(), config.pluginTimeout)
+	defer cancel()
+
+	// plugin may come with arguments, e.g. 'python3 plugin.py'
+	args := strings.Fields(config.plugin)
+	if len(args) == 0 {
+		return errors.New("plugin command is empty")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(timeout, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if timeout.Err() == context.DeadlineExceeded {
+			return errors.Errorf("plugin timed out after %s", config.pluginTimeout)
+		}
+		if msg := lastLine(stderr.String()); msg != "" {
+			return errors.Wrapf(err, "plugin failed: %s", msg)
+		}
+		return errors.Wrap(err, "plugin failed")
+	}
+
+	var resp pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return errors.Wrap(err, "could not decode plugin response")
+	}
+
+	if resp.Error != "" {
+		return errors.Errorf("plugin reported error: %s", resp.Error)
+	}
+
+	if resp.Colors != nil && len(resp.Colors) != len(cells) {
+		return errors.Errorf("plugin returned %d colors, expected %d", len(resp.Colors), len(cells))
+	}
+
+	if resp.Chars != "" && len(resp.Chars) != len(cells) {
+		return errors.Errorf("plugin returned %d chars, expected %d", len(resp.Chars), len(cells))
+	}
+
+	for i, value := range resp.Colors {
+		if value == "" {
+			continue
+		}
+
+		var c color
+		if err := c.Set(value); err != nil {
+			return errors.Wrapf(err, "plugin returned invalid color at cell %d", i)
+		}
+		colors[i] = sdl.Color(c)
+	}
+
+	for i := 0; i < len(resp.Chars); i++ {
+		char := resp.Chars[i]
+		if char < 0x21 || char > 0x7e {
+			return errors.Errorf("plugin returned invalid char at cell %d, should be visible ascii", i)
+		}
+		cells[i].Char = char
+	}
+
+	return nil
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"io"
+	"math"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// bandHeight is the number of pixel rows rendered at a time when
+// writing png, tiff and pdf, it bounds the pixel buffers only, cells,
+// colors and placed glyphs of the whole poster stay in memory
+const bandHeight = 256
+
+// writePNG renders the poster band by band and streams rows into a png
+func writePNG(outputName string, ctx *sdlContext, cells []Cell, colors []sdl.Color, texts []textItem) error {
+	f, err := os.Create(outputName)
+	if err != nil {
+		return errors.Wrap(err, "could not create png")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	bounds := newCanvas(ctx).bounds
+	stream, err := newPNGStream(w, bounds.Dx(), bounds.Dy(), config.dpi)
+	if err != nil {
+		return err
+	}
+
+	if err := renderCanvas(ctx, cells, colors, texts, stream.writeRows); err != nil {
+		return err
+	}
+
+	if err := stream.close(); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "could not write png")
+	}
+
+	return nil
+}
+
+// pngStream is a minimal png encoder taking rows incrementally,
+// image/png needs the whole image in memory
+type pngStream struct {
+	w      io.Writer
+	idat   *idatWriter
+	zw     *zlib.Writer
+	width  int
+	height int
+	rows   int
+	prev   []byte // previous row, filter byte excluded
+	cur    []byte
+	line   []byte // filter byte and filtered row
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// newPNGStream writes the header, dpi goes to the pHYs chunk
+func newPNGStream(w io.Writer, width, height, dpi int) (*pngStream, error) {
+	if _, err := io.WriteString(w, pngSignature); err != nil {
+		return nil, errors.Wrap(err, "could not write png")
+	}
+
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 8  // bit depth
+	ihdr[9] = 6  // color type: rgba
+	ihdr[10] = 0 // compression
+	ihdr[11] = 0 // filter
+	ihdr[12] = 0 // interlace
+	if err := writeChunk(w, "IHDR", ihdr[:]); err != nil {
+		return nil, err
+	}
+
+	var phys [9]byte
+	perMeter := uint32(math.Round(float64(dpi) / 0.0254))
+	binary.BigEndian.PutUint32(phys[0:4], perMeter)
+	binary.BigEndian.PutUint32(phys[4:8], perMeter)
+	phys[8] = 1 // unit: meter
+	if err := writeChunk(w, "pHYs", phys[:]); err != nil {
+		return nil, err
+	}
+
+	idat := &idatWriter{w: w}
+	zw, err := zlib.NewWriterLevel(idat, zlib.DefaultCompression)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create zlib writer")
+	}
+
+	return &pngStream{
+		w:      w,
+		idat:   idat,
+		zw:     zw,
+		width:  width,
+		height: height,
+		prev:   make([]byte, width*4),
+		cur:    make([]byte, width*4),
+		line:   make([]byte, 1+width*4),
+	}, nil
+}
+
+// writeRows appends all rows of img, img must be as wide as the png
+func (p *pngStream) writeRows(img *image.RGBA) error {
+	bounds := img.Bounds()
+	if bounds.Dx() != p.width {
+		return errors.Errorf("png row width is %d, expected %d", bounds.Dx(), p.width)
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if p.rows == p.height {
+			return errors.New("too many png rows")
+		}
+
+		// png stores non-premultiplied alpha
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):]
+		for i := 0; i < p.width*4; i += 4 {
+			r, g, b, a := row[i], row[i+1], row[i+2], row[i+3]
+			if a != 0 && a != 0xff {
+				r = uint8(uint32(r) * 0xff / uint32(a))
+				g = uint8(uint32(g) * 0xff / uint32(a))
+				b = uint8(uint32(b) * 0xff / uint32(a))
+			}
+			p.cur[i], p.cur[i+1], p.cur[i+2], p.cur[i+3] = r, g, b, a
+		}
+
+		// 'up' filter, lines of a code poster repeat a lot vertically
+		p.line[0] = 2
+		for i, v := range p.cur {
+			p.line[i+1] = v - p.prev[i]
+		}
+
+		if _, err := p.zw.Write(p.line); err != nil {
+			return errors.Wrap(err, "could not write png")
+		}
+
+		p.prev, p.cur = p.cur, p.prev
+		p.rows++
+	}
+
+	return nil
+}
+
+func (p *pngStream) close() error {
+	if p.rows != p.height {
+		return errors.Errorf("png has %d rows, expected %d", p.rows, p.height)
+	}
+
+	if err := p.zw.Close(); err != nil {
+		return errors.Wrap(err, "could not write png")
+	}
+
+	if err := p.idat.flush(); err != nil {
+		return err
+	}
+
+	return writeChunk(p.w, "IEND", nil)
+}
+
+// idatWriter splits compressed data into IDAT chunks
+type idatWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+const idatChunkSize = 1 << 16
+
+func (i *idatWriter) Write(data []byte) (int, error) {
+	i.buf = append(i.buf, data...)
+	for len(i.buf) >= idatChunkSize {
+		if err := writeChunk(i.w, "IDAT", i.buf[:idatChunkSize]); err != nil {
+			return 0, err
+		}
+		i.buf = append(i.buf[:0], i.buf[idatChunkSize:]...)
+	}
+
+	return len(data), nil
+}
+
+func (i *idatWriter) flush() error {
+	if len(i.buf) == 0 {
+		return nil
+	}
+
+	err := writeChunk(i.w, "IDAT", i.buf)
+	i.buf = i.buf[:0]
+
+	return err
+}
+
+func writeChunk(w io.Writer, name string, data []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], name)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+
+	var footer [4]byte
+	binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+
+	for _, b := range [][]byte{header[:], data, footer[:]} {
+		if _, err := w.Write(b); err != nil {
+			return errors.Wrap(err, "could not write png")
+		}
+	}
+
+	return nil
+}
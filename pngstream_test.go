@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	imgcolor "image/color"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+func TestPNGStreamRoundTrip(t *testing.T) {
+	// noise does not compress, so the data spans several IDAT chunks
+	const width, height = 300, 200
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	rnd := rand.New(rand.NewSource(1))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var c imgcolor.NRGBA
+			switch x % 3 {
+			case 0:
+				c = imgcolor.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 0xff}
+			case 1:
+				c = imgcolor.NRGBA{0x20, 0x40, 0x80, 0x80}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	stream, err := newPNGStream(&buf, width, height, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows come in bands like the renderer writes them
+	for y := 0; y < height; y += 50 {
+		band := img.SubImage(image.Rect(0, y, width, minInt(y+50, height))).(*image.RGBA)
+		if err := stream.writeRows(band); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := bytes.Count(buf.Bytes(), []byte("IDAT")); n < 2 {
+		t.Errorf("png has %d IDAT chunks, expected several", n)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("pHYs")) {
+		t.Error("png has no pHYs chunk")
+	}
+
+	decoded, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds() != img.Bounds() {
+		t.Fatalf("decoded bounds %v, want %v", decoded.Bounds(), img.Bounds())
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			got := imgcolor.NRGBAModel.Convert(decoded.At(x, y)).(imgcolor.NRGBA)
+			want := imgcolor.NRGBAModel.Convert(img.At(x, y)).(imgcolor.NRGBA)
+			if !nrgbaClose(got, want) {
+				t.Fatalf("pixel %d,%d is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+// nrgbaClose allows rounding of un-premultiplying semi-transparent pixels
+func nrgbaClose(a, b imgcolor.NRGBA) bool {
+	near := func(x, y uint8) bool {
+		return x-y <= 1 || y-x <= 1
+	}
+	return a.A == b.A && near(a.R, b.R) && near(a.G, b.G) && near(a.B, b.B)
+}
+
+func TestPNGStreamRows(t *testing.T) {
+	var buf bytes.Buffer
+	stream, err := newPNGStream(&buf, 4, 2, 72)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stream.writeRows(image.NewRGBA(image.Rect(0, 0, 3, 1))); err == nil {
+		t.Error("row of a different width should fail")
+	}
+
+	if err := stream.writeRows(image.NewRGBA(image.Rect(0, 0, 4, 1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.close(); err == nil {
+		t.Error("closing with missing rows should fail")
+	}
+
+	if err := stream.writeRows(image.NewRGBA(image.Rect(0, 0, 4, 2))); err == nil {
+		t.Error("rows past the height should fail")
+	}
+}
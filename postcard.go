@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	imgcolor "image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+	"github.com/veandco/go-sdl2/ttf"
+)
+
+// postcard size in mm, landscape
+const (
+	postcardWidth  = 148.0
+	postcardHeight = 100.0
+
+	postcardAddressLines = 4
+)
+
+type postcardData struct {
+	templateData
+	Message string
+	To      []string
+}
+
+// the back side is made of three blocks, a user template may redefine any of them
+const defaultBackTemplate = `{{define "message"}}{{.Message}}{{end}}
+{{define "address"}}{{range .To}}{{.}}
+{{end}}{{end}}
+{{define "caption"}}{{.Repo}} · {{.File}}{{if .GitCommit}} @ {{.GitCommit}}{{end}}{{end}}`
+
+func executeBlock(t *template.Template, name string, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", errors.Wrapf(err, "could not execute %s template", name)
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// writePostcard writes a two pages pdf, the poster on the front and
+// message, address, stamp box and caption on the back
+func writePostcard(p *poster) (string, error) {
+	t, err := template.New("back").Parse(defaultBackTemplate)
+	if err != nil {
+		return "", errors.Wrap(err, "could not parse back template")
+	}
+
+	if config.postcardTemplate != "" {
+		content, err := ioutil.ReadFile(config.postcardTemplate)
+		if err != nil {
+			return "", errors.Wrap(err, "could not read back template")
+		}
+		if t, err = t.Parse(string(content)); err != nil {
+			return "", errors.Wrap(err, "could not parse back template")
+		}
+	}
+
+	data := postcardData{newTemplateData(p.code), config.postcardMessage, config.postcardTo}
+
+	// the message itself may use template variables
+	message, err := template.New("message").Parse(data.Message)
+	if err != nil {
+		return "", errors.Wrap(err, "could not parse message")
+	}
+	if data.Message, err = executeBlock(message, "message", data); err != nil {
+		return "", err
+	}
+
+	front, err := postcardFront(p)
+	if err != nil {
+		return "", err
+	}
+
+	back, err := postcardBack(t, data)
+	if err != nil {
+		return "", err
+	}
+
+	outputName := config.output
+	if outputName == "" {
+		outputName = outputPath("postcard.pdf")
+	}
+	f, err := os.Create(outputName)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create pdf")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	pdf, err := newPDFWriter(w)
+	if err != nil {
+		return "", err
+	}
+
+	gcr := cmykGCRs[config.cmykGCR]
+	for _, side := range []*image.RGBA{front, back} {
+		page := pdfPage{
+			pixelsWide: side.Bounds().Dx(),
+			pixelsHigh: side.Bounds().Dy(),
+			colorSpace: "/DeviceCMYK",
+			width:      postcardWidth,
+			height:     postcardHeight,
+		}
+
+		err := pdf.addPage(page, func(w io.Writer) error {
+			_, err := w.Write(cmykRows(side, gcr, nil))
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := pdf.close(); err != nil {
+		return "", err
+	}
+
+	if err := w.Flush(); err != nil {
+		return "", errors.Wrap(err, "could not write pdf")
+	}
+
+	return outputName, nil
+}
+
+func newPostcardSide() *image.RGBA {
+	side := image.NewRGBA(image.Rect(0, 0, mmToPixels(postcardWidth), mmToPixels(postcardHeight)))
+	draw.Draw(side, side.Bounds(), image.White, image.Point{}, draw.Src)
+	return side
+}
+
+// postcardFontSize is the largest font size whose poster fits the
+// card at --dpi, the front is rendered at that size instead of resized
+func postcardFontSize() (int, error) {
+	ctx, err := initSDLAndTTF(config.fontSize)
+	if err != nil {
+		return 0, err
+	}
+
+	cardWidth, cardHeight := mmToPixels(postcardWidth), mmToPixels(postcardHeight)
+	fits := func(size int) (bool, error) {
+		font, err := openFont(config.fontPath, size)
+		if err != nil {
+			return false, err
+		}
+		w, h, err := font.SizeUTF8("a")
+		if err != nil {
+			return false, errors.Wrap(err, "could not get size of character")
+		}
+		return w*(config.width+config.padding.horizontal*2) <= cardWidth &&
+			h*(config.height+config.padding.vertical*2) <= cardHeight, nil
+	}
+
+	// start from the proportional size, glyph sizes are rounded so
+	// step to the exact one
+	scale := math.Min(float64(cardWidth)/float64(ctx.winWidth), float64(cardHeight)/float64(ctx.winHeight))
+	size := maxInt(1, int(float64(config.fontSize)*scale))
+	for {
+		ok, err := fits(size + 1)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		size++
+	}
+	for {
+		ok, err := fits(size)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return size, nil
+		}
+		if size == 1 {
+			return 0, errors.Errorf("poster of %dx%d characters does not fit the postcard at %d dpi", config.width, config.height, config.dpi)
+		}
+		size--
+	}
+}
+
+// postcardFront centers the poster, rendered at print resolution, on
+// the card filled with its background color
+func postcardFront(p *poster) (*image.RGBA, error) {
+	side := newPostcardSide()
+	draw.Draw(side, side.Bounds(), image.NewUniform(imgcolor.NRGBA(config.bgColor)), image.Point{}, draw.Over)
+
+	renderer, err := newRegionRenderer(p.ctx, p.cells, p.colors, p.texts)
+	if err != nil {
+		return nil, err
+	}
+	img := renderer.render(image.Rect(0, 0, p.ctx.winWidth, p.ctx.winHeight))
+
+	bounds := side.Bounds()
+	at := image.Pt((bounds.Dx()-p.ctx.winWidth)/2, (bounds.Dy()-p.ctx.winHeight)/2)
+	draw.Draw(side, img.Bounds().Add(at), img, image.Point{}, draw.Over)
+
+	return side, nil
+}
+
+func ptToPixels(pt float64) int {
+	return int(math.Round(pt * float64(config.dpi) / 72))
+}
+
+// postcardBack lays out the classic back side, message on the left,
+// stamp box and address lines on the right
+func postcardBack(t *template.Template, data postcardData) (*image.RGBA, error) {
+	side := newPostcardSide()
+	gray := imgcolor.NRGBA{0x88, 0x88, 0x88, 0xff}
+	thin := mmToPixels(0.25)
+	if thin < 1 {
+		thin = 1
+	}
+
+	fontOf := func(pt float64) (*ttf.Font, error) {
+		return openFont(config.fontPath, ptToPixels(pt))
+	}
+
+	text := func(s string, pt float64, c imgcolor.NRGBA, x, y int) error {
+		if s == "" {
+			return nil
+		}
+		font, err := fontOf(pt)
+		if err != nil {
+			return err
+		}
+		mask, err := textMask(font, s)
+		if err != nil {
+			return err
+		}
+		drawMask(side, mask, sdl.Color(c), image.Pt(x, y))
+		return nil
+	}
+
+	// title and divider
+	if err := text("POSTCARD", 9, gray, mmToPixels(8), mmToPixels(7)); err != nil {
+		return nil, err
+	}
+	fillRect(side, image.Rect(mmToPixels(76), mmToPixels(14), mmToPixels(76)+thin, mmToPixels(88)), gray)
+
+	// message
+	message, err := executeBlock(t, "message", data)
+	if err != nil {
+		return nil, err
+	}
+	messageFont, err := fontOf(10)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := wrapText(messageFont, message, mmToPixels(62))
+	if err != nil {
+		return nil, err
+	}
+	lineHeight := int(float64(messageFont.Height()) * 1.4)
+	for i, line := range lines {
+		y := mmToPixels(16) + i*lineHeight
+		if y+lineHeight > mmToPixels(88) {
+			log.Printf("message is cut after %d of %d lines to fit the postcard\n", i, len(lines))
+			break
+		}
+		if err := text(line, 10, markColor, mmToPixels(8), y); err != nil {
+			return nil, err
+		}
+	}
+
+	// stamp box
+	stamp := image.Rect(mmToPixels(118), mmToPixels(8), mmToPixels(140), mmToPixels(34))
+	outline(side, stamp, thin, gray)
+	stampFont, err := fontOf(6)
+	if err != nil {
+		return nil, err
+	}
+	w, h, err := stampFont.SizeUTF8("STAMP")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get size of text")
+	}
+	center := stamp.Min.Add(stamp.Max).Div(2)
+	if err := text("STAMP", 6, gray, center.X-w/2, center.Y-h/2); err != nil {
+		return nil, err
+	}
+
+	// address lines, text sits on the rules
+	address, err := executeBlock(t, "address", data)
+	if err != nil {
+		return nil, err
+	}
+	addressLines := strings.Split(address, "\n")
+	if len(addressLines) > postcardAddressLines {
+		return nil, errors.Errorf("address has %d lines, the postcard has room for %d", len(addressLines), postcardAddressLines)
+	}
+	addressFont, err := fontOf(11)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < postcardAddressLines; i++ {
+		y := mmToPixels(52 + float64(i)*10)
+		fillRect(side, image.Rect(mmToPixels(82), y, mmToPixels(140), y+thin), gray)
+
+		if i < len(addressLines) {
+			if err := text(strings.TrimSpace(addressLines[i]), 11, markColor, mmToPixels(83), y-addressFont.Height()-mmToPixels(0.5)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// caption
+	caption, err := executeBlock(t, "caption", data)
+	if err != nil {
+		return nil, err
+	}
+	if err := text(caption, 6, gray, mmToPixels(8), mmToPixels(92)); err != nil {
+		return nil, err
+	}
+
+	return side, nil
+}
+
+// wrapText breaks text into lines not wider than width, by words, or
+// by characters when a word is too long, e.g. chinese
+func wrapText(font *ttf.Font, text string, width int) ([]string, error) {
+	fits := func(s string) (bool, error) {
+		w, _, err := font.SizeUTF8(s)
+		if err != nil {
+			return false, errors.Wrap(err, "could not get size of text")
+		}
+		return w <= width, nil
+	}
+
+	var result []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.FieldsFunc(paragraph, unicode.IsSpace) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+
+			ok, err := fits(candidate)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				line = candidate
+				continue
+			}
+
+			if line != "" {
+				result = append(result, line)
+			}
+
+			// break the word itself
+			line = ""
+			for _, r := range word {
+				ok, err := fits(line + string(r))
+				if err != nil {
+					return nil, err
+				}
+				if !ok && line != "" {
+					result = append(result, line)
+					line = ""
+				}
+				line += string(r)
+			}
+		}
+		result = append(result, line)
+	}
+
+	return result, nil
+}
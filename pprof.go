@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	imgcolor "image/color"
+	"io/ioutil"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// hotness holds sample values of a pprof profile by source file and line
+type hotness struct {
+	lines map[string]map[int]int64
+	max   int64
+}
+
+type pprofLine struct {
+	functionID uint64
+	line       int64
+}
+
+type pprofFunction struct {
+	filename int64 // index of string table
+}
+
+// readPprof reads a gzipped profile.proto, the value of the last sample
+// type is used, e.g. cpu nanoseconds of a cpu profile
+func readPprof(profilePath string) (*hotness, error) {
+	files, err := sourceFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(profilePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read pprof profile")
+	}
+
+	// profiles written by runtime/pprof are gzipped
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decompress pprof profile")
+		}
+		data, err = ioutil.ReadAll(gz)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decompress pprof profile")
+		}
+	}
+
+	var (
+		samples     [][]uint64 // location ids
+		values      [][]int64
+		locations   = make(map[uint64][]pprofLine)
+		functions   = make(map[uint64]pprofFunction)
+		strs        []string
+		sampleTypes int
+	)
+
+	err = decodeProto(data, func(field int, v uint64, msg []byte) error {
+		switch field {
+		case 1: // sample_type
+			sampleTypes++
+		case 2: // sample
+			var ids []uint64
+			var vals []int64
+			err := decodeProto(msg, func(field int, v uint64, msg []byte) error {
+				switch field {
+				case 1:
+					return decodePacked(v, msg, func(v uint64) { ids = append(ids, v) })
+				case 2:
+					return decodePacked(v, msg, func(v uint64) { vals = append(vals, int64(v)) })
+				}
+				return nil
+			})
+			samples = append(samples, ids)
+			values = append(values, vals)
+			return err
+		case 4: // location
+			var id uint64
+			var lines []pprofLine
+			err := decodeProto(msg, func(field int, v uint64, msg []byte) error {
+				switch field {
+				case 1:
+					id = v
+				case 4:
+					var line pprofLine
+					err := decodeProto(msg, func(field int, v uint64, msg []byte) error {
+						switch field {
+						case 1:
+							line.functionID = v
+						case 2:
+							line.line = int64(v)
+						}
+						return nil
+					})
+					lines = append(lines, line)
+					return err
+				}
+				return nil
+			})
+			locations[id] = lines
+			return err
+		case 5: // function
+			var id uint64
+			var fn pprofFunction
+			err := decodeProto(msg, func(field int, v uint64, msg []byte) error {
+				switch field {
+				case 1:
+					id = v
+				case 4:
+					fn.filename = int64(v)
+				}
+				return nil
+			})
+			functions[id] = fn
+			return err
+		case 6: // string_table
+			strs = append(strs, string(msg))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode pprof profile")
+	}
+
+	matcher := newFileMatcher(files)
+	result := &hotness{lines: make(map[string]map[int]int64)}
+
+	type fileLine struct {
+		file string
+		line int
+	}
+
+	for i, ids := range samples {
+		if len(values[i]) == 0 || len(values[i]) != sampleTypes {
+			continue
+		}
+		value := values[i][len(values[i])-1]
+
+		// count each line once per sample
+		seen := make(map[fileLine]bool)
+
+		for depth, id := range ids {
+			lines := locations[id]
+			for j, line := range lines {
+				// lines of a location are inlined calls, the first is the innermost
+				if config.pprofMode == "flat" && (depth > 0 || j > 0) {
+					break
+				}
+
+				fn, ok := functions[line.functionID]
+				if !ok || fn.filename < 0 || fn.filename >= int64(len(strs)) {
+					continue
+				}
+
+				file := matcher.match(strs[fn.filename])
+				key := fileLine{file, int(line.line)}
+				if file == "" || seen[key] {
+					continue
+				}
+				seen[key] = true
+
+				if result.lines[file] == nil {
+					result.lines[file] = make(map[int]int64)
+				}
+				result.lines[file][key.line] += value
+				if result.lines[file][key.line] > result.max {
+					result.max = result.lines[file][key.line]
+				}
+			}
+		}
+	}
+
+	if result.max == 0 {
+		return nil, errors.New("pprof profile has no samples for the source code")
+	}
+
+	return result, nil
+}
+
+// Color maps sample value of the line to heat colors on a log scale,
+// lines without samples are transparent
+func (h *hotness) Color(cell Cell) imgcolor.NRGBA {
+	value := h.lines[cell.File][cell.Line]
+	if value <= 0 {
+		return imgcolor.NRGBA{}
+	}
+
+	t := math.Log1p(float64(value)) / math.Log1p(float64(h.max))
+
+	return imgcolor.NRGBA(gradientAt(config.heatColors, t))
+}
+
+// decodeProto calls fn for each field of a protobuf message, v is the
+// value of varint fields and msg the bytes of length delimited fields
+func decodeProto(buf []byte, fn func(field int, v uint64, msg []byte) error) error {
+	for len(buf) > 0 {
+		key, n := decodeVarint(buf)
+		if n == 0 {
+			return errors.New("invalid varint")
+		}
+		buf = buf[n:]
+
+		field := int(key >> 3)
+		var v uint64
+		var msg []byte
+
+		switch key & 7 {
+		case 0: // varint
+			v, n = decodeVarint(buf)
+			if n == 0 {
+				return errors.New("invalid varint")
+			}
+			buf = buf[n:]
+		case 1: // 64-bit
+			if len(buf) < 8 {
+				return errors.New("unexpected end of message")
+			}
+			buf = buf[8:]
+			continue
+		case 2: // length delimited
+			length, n := decodeVarint(buf)
+			if n == 0 || uint64(len(buf)-n) < length {
+				return errors.New("unexpected end of message")
+			}
+			msg = buf[n : n+int(length)]
+			buf = buf[n+int(length):]
+		case 5: // 32-bit
+			if len(buf) < 4 {
+				return errors.New("unexpected end of message")
+			}
+			buf = buf[4:]
+			continue
+		default:
+			return errors.Errorf("unsupported wire type %d", key&7)
+		}
+
+		if err := fn(field, v, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodePacked handles repeated varint fields, which may be packed or not
+func decodePacked(v uint64, msg []byte, fn func(v uint64)) error {
+	if msg == nil {
+		fn(v)
+		return nil
+	}
+
+	for len(msg) > 0 {
+		v, n := decodeVarint(msg)
+		if n == 0 {
+			return errors.New("invalid packed varint")
+		}
+		fn(v)
+		msg = msg[n:]
+	}
+
+	return nil
+}
+
+func decodeVarint(buf []byte) (uint64, int) {
+	var result uint64
+
+	for i := 0; i < len(buf) && i < 10; i++ {
+		result |= uint64(buf[i]&0x7f) << (7 * uint(i))
+		if buf[i] < 0x80 {
+			return result, i + 1
+		}
+	}
+
+	return 0, 0
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// crop marks start a bit outside the bleed
+const (
+	cropMarkGap    = 2.0  // mm
+	cropMarkLength = 5.0  // mm
+	cropMarkWidth  = 0.25 // mm
+)
+
+// canvas is the area of png, tiff and pdf output in pixels, trim is
+// the poster itself at (0, 0), bounds may extend past it for bleed
+// and crop marks
+type canvas struct {
+	trim   image.Rectangle
+	bleed  image.Rectangle
+	bounds image.Rectangle
+}
+
+// mmToPixels converts at config.dpi
+func mmToPixels(mm float64) int {
+	return int(math.Round(mm * float64(config.dpi) / 25.4))
+}
+
+func pixelsToMM(px int) float64 {
+	return float64(px) * 25.4 / float64(config.dpi)
+}
+
+func newCanvas(ctx *sdlContext) canvas {
+	c := canvas{trim: image.Rect(0, 0, ctx.winWidth, ctx.winHeight)}
+
+	bleed := mmToPixels(config.bleed)
+	c.bleed = c.trim.Inset(-bleed)
+
+	c.bounds = c.bleed
+	if config.cropMarks {
+		c.bounds = c.trim.Inset(-mmToPixels(config.bleed + cropMarkGap + cropMarkLength + cropMarkGap))
+	}
+
+	return c
+}
+
+// renderCanvas renders the canvas band by band, bands have bounds in
+// canvas coordinates and are only valid until emit returns
+func renderCanvas(ctx *sdlContext, cells []Cell, colors []sdl.Color, texts []textItem, emit func(band *image.RGBA) error) error {
+	renderer, err := newRegionRenderer(ctx, cells, colors, texts)
+	if err != nil {
+		return err
+	}
+
+	c := newCanvas(ctx)
+	gap := mmToPixels(config.bleed + cropMarkGap)
+	thickness := mmToPixels(cropMarkWidth)
+	if thickness < 1 {
+		thickness = 1
+	}
+
+	for y := c.bounds.Min.Y; y < c.bounds.Max.Y; y += bandHeight {
+		rect := image.Rect(c.bounds.Min.X, y, c.bounds.Max.X, y+bandHeight).Intersect(c.bounds)
+
+		band := renderer.render(rect)
+		band.Rect = rect
+
+		if c.bounds != c.bleed {
+			// paper outside the bleed
+			for _, r := range []image.Rectangle{
+				image.Rect(c.bounds.Min.X, c.bounds.Min.Y, c.bounds.Max.X, c.bleed.Min.Y),
+				image.Rect(c.bounds.Min.X, c.bleed.Max.Y, c.bounds.Max.X, c.bounds.Max.Y),
+				image.Rect(c.bounds.Min.X, c.bleed.Min.Y, c.bleed.Min.X, c.bleed.Max.Y),
+				image.Rect(c.bleed.Max.X, c.bleed.Min.Y, c.bounds.Max.X, c.bleed.Max.Y),
+			} {
+				draw.Draw(band, r, image.White, image.Point{}, draw.Src)
+			}
+
+			drawCropMarks(band, c.trim, gap, mmToPixels(cropMarkLength), thickness)
+		}
+
+		if err := emit(band); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cmykGCR converts rgb to cmyk by a plain gray component replacement
+// formula, a rough approximation and not an icc profile, black is how
+// much of the common gray goes to the black ink and inkLimit the max
+// total coverage, 3 is 300%
+type cmykGCR struct {
+	black    float64
+	inkLimit float64
+}
+
+var cmykGCRs = map[string]cmykGCR{
+	"light":  {0.7, 3.2},
+	"medium": {0.8, 2.8},
+	"heavy":  {0.9, 2.4},
+}
+
+// convert takes premultiplied rgba, transparent pixels show white paper
+func (p cmykGCR) convert(r, g, b, a uint8) (uint8, uint8, uint8, uint8) {
+	white := 0xff - float64(a)
+	c := 1 - (float64(r)+white)/0xff
+	m := 1 - (float64(g)+white)/0xff
+	y := 1 - (float64(b)+white)/0xff
+
+	k := math.Min(c, math.Min(m, y)) * p.black
+	c, m, y = c-k, m-k, y-k
+
+	if total := c + m + y + k; total > p.inkLimit {
+		scale := (p.inkLimit - k) / (c + m + y)
+		c, m, y = c*scale, m*scale, y*scale
+	}
+
+	return clamp8(c * 0xff), clamp8(m * 0xff), clamp8(y * 0xff), clamp8(k * 0xff)
+}
+
+// cmykRows converts a band to rows of cmyk samples
+func cmykRows(band *image.RGBA, gcr cmykGCR, samples []byte) []byte {
+	samples = samples[:0]
+	for i := 0; i < len(band.Pix); i += 4 {
+		c, m, y, k := gcr.convert(band.Pix[i], band.Pix[i+1], band.Pix[i+2], band.Pix[i+3])
+		samples = append(samples, c, m, y, k)
+	}
+
+	return samples
+}
+
+// writeTIFF writes a cmyk tiff with resolution tags
+func writeTIFF(outputName string, ctx *sdlContext, cells []Cell, colors []sdl.Color, texts []textItem) error {
+	f, err := os.Create(outputName)
+	if err != nil {
+		return errors.Wrap(err, "could not create tiff")
+	}
+	defer f.Close()
+
+	bounds := newCanvas(ctx).bounds
+	t, err := newTIFFWriter(f, bounds.Dx(), bounds.Dy(), bandHeight, config.dpi)
+	if err != nil {
+		return err
+	}
+
+	gcr := cmykGCRs[config.cmykGCR]
+	var samples []byte
+
+	err = renderCanvas(ctx, cells, colors, texts, func(band *image.RGBA) error {
+		samples = cmykRows(band, gcr, samples)
+		return t.writeStrip(samples)
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.close()
+}
+
+// writePDF writes a cmyk pdf of the poster, with trim and bleed boxes
+// when there is bleed or crop marks
+func writePDF(outputName string, ctx *sdlContext, cells []Cell, colors []sdl.Color, texts []textItem) error {
+	f, err := os.Create(outputName)
+	if err != nil {
+		return errors.Wrap(err, "could not create pdf")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	pdf, err := newPDFWriter(w)
+	if err != nil {
+		return err
+	}
+
+	c := newCanvas(ctx)
+	page := pdfPage{
+		pixelsWide: c.bounds.Dx(),
+		pixelsHigh: c.bounds.Dy(),
+		colorSpace: "/DeviceCMYK",
+		width:      pixelsToMM(c.bounds.Dx()),
+		height:     pixelsToMM(c.bounds.Dy()),
+		trim:       pixelsToMM(c.trim.Min.X - c.bounds.Min.X),
+		bleed:      pixelsToMM(c.trim.Min.X - c.bleed.Min.X),
+	}
+
+	gcr := cmykGCRs[config.cmykGCR]
+	var samples []byte
+
+	err = pdf.addPage(page, func(w io.Writer) error {
+		return renderCanvas(ctx, cells, colors, texts, func(band *image.RGBA) error {
+			samples = cmykRows(band, gcr, samples)
+			_, err := w.Write(samples)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := pdf.close(); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "could not write pdf")
+	}
+
+	return nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	imgcolor "image/color"
+	"image/draw"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nfnt/resize"
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+	"github.com/veandco/go-sdl2/ttf"
+)
+
+// paper sizes in mm, portrait
+var papers = map[string][2]float64{
+	"a4":     {210, 297},
+	"letter": {215.9, 279.4},
+}
+
+// printMargin is left on every side of a page, most printers can not
+// print to the edge, crop and registration marks are drawn inside it
+const printMargin = 12.0 // mm
+
+var (
+	markColor  = imgcolor.NRGBA{0, 0, 0, 0xff}
+	guideColor = imgcolor.NRGBA{0x99, 0x99, 0x99, 0xff}
+)
+
+// printLayout maps the poster onto pages, all sizes are in pixels
+// of the poster which are printed at config.printDPI
+type printLayout struct {
+	pageWidth, pageHeight int // whole paper
+	margin                int
+	areaWidth, areaHeight int // printable area
+	overlap               int
+	cols, rows            int
+	paperWidth            float64 // mm
+	paperHeight           float64 // mm
+}
+
+func (p *printLayout) px(mm float64) int {
+	return int(math.Round(mm * float64(config.printDPI) / 25.4))
+}
+
+// line returns the thickness of a line in pixels, at least one
+func (p *printLayout) line(mm float64) int {
+	if t := p.px(mm); t > 1 {
+		return t
+	}
+	return 1
+}
+
+func newPrintLayout(posterWidth, posterHeight int) (*printLayout, error) {
+	size := papers[config.print]
+	if config.printLandscape {
+		size[0], size[1] = size[1], size[0]
+	}
+
+	l := &printLayout{paperWidth: size[0], paperHeight: size[1]}
+	l.pageWidth, l.pageHeight = l.px(size[0]), l.px(size[1])
+	l.margin = l.px(printMargin)
+	l.areaWidth, l.areaHeight = l.pageWidth-2*l.margin, l.pageHeight-2*l.margin
+	l.overlap = l.px(config.printOverlap)
+
+	if l.overlap*2 >= l.areaWidth || l.overlap*2 >= l.areaHeight {
+		return nil, errors.Errorf("print overlap %.1fmm is too large for %s", config.printOverlap, config.print)
+	}
+
+	pages := func(total, area int) int {
+		if total <= area {
+			return 1
+		}
+		return int(math.Ceil(float64(total-l.overlap) / float64(area-l.overlap)))
+	}
+	l.cols, l.rows = pages(posterWidth, l.areaWidth), pages(posterHeight, l.areaHeight)
+
+	return l, nil
+}
+
+// region returns the part of the poster printed on page (col, row)
+func (l *printLayout) region(col, row int) image.Rectangle {
+	x := col * (l.areaWidth - l.overlap)
+	y := row * (l.areaHeight - l.overlap)
+	return image.Rect(x, y, x+l.areaWidth, y+l.areaHeight)
+}
+
+// printBase is the poster name without its extension, so outputs of
+// batch jobs, which are unique, give unique print pages too
+func printBase(posterName string) string {
+	return strings.TrimSuffix(posterName, filepath.Ext(posterName))
+}
+
+// writePrintPages splits the poster into numbered pages with crop and
+// registration marks plus an assembly map, as one pdf or a directory of pngs
+// named after the poster, e.g. 'main.go.print.pdf' for 'main.go.png'
+func writePrintPages(posterName string, ctx *sdlContext, cells []Cell, colors []sdl.Color, texts []textItem) (string, error) {
+	layout, err := newPrintLayout(ctx.winWidth, ctx.winHeight)
+	if err != nil {
+		return "", err
+	}
+
+	renderer, err := newRegionRenderer(ctx, cells, colors, texts)
+	if err != nil {
+		return "", err
+	}
+
+	// labels are 9pt whatever the poster font size is
+	labelFont, err := openFont(config.fontPath, int(math.Round(9*float64(config.printDPI)/72)))
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		outputName string
+		pdf        *pdfWriter
+		pdfFile    *os.File
+		buffered   *bufio.Writer
+	)
+
+	if config.printFormat == "pdf" {
+		outputName = uniqueOutputPath(printBase(posterName), "print.pdf", nil)
+		pdfFile, err = os.Create(outputName)
+		if err != nil {
+			return "", errors.Wrap(err, "could not create pdf")
+		}
+		defer pdfFile.Close()
+
+		buffered = bufio.NewWriter(pdfFile)
+		if pdf, err = newPDFWriter(buffered); err != nil {
+			return "", err
+		}
+	} else {
+		outputName = uniqueOutputPath(printBase(posterName), "print", nil)
+		if err := os.Mkdir(outputName, 0755); err != nil {
+			return "", errors.Wrap(err, "could not create print directory")
+		}
+	}
+
+	emit := func(page *image.RGBA, name string) error {
+		if pdf != nil {
+			return pdf.addImagePage(page, layout.paperWidth, layout.paperHeight)
+		}
+		return savePNG(filepath.Join(outputName, name), page)
+	}
+
+	assembly, err := layout.assemblyMap(ctx, cells, colors, labelFont)
+	if err != nil {
+		return "", err
+	}
+	if err := emit(assembly, "map.png"); err != nil {
+		return "", err
+	}
+
+	total := layout.cols * layout.rows
+	poster := image.Rect(0, 0, ctx.winWidth, ctx.winHeight)
+
+	for row := 0; row < layout.rows; row++ {
+		for col := 0; col < layout.cols; col++ {
+			number := row*layout.cols + col + 1
+			region := layout.region(col, row).Intersect(poster)
+
+			page := image.NewRGBA(image.Rect(0, 0, layout.pageWidth, layout.pageHeight))
+			draw.Draw(page, page.Bounds(), image.White, image.Point{}, draw.Src)
+
+			origin := image.Pt(layout.margin, layout.margin)
+			printed := image.Rectangle{origin, origin.Add(region.Size())}
+			draw.Draw(page, printed, renderer.render(region), image.Point{}, draw.Over)
+
+			layout.drawGuides(page, printed, col, row)
+			drawCropMarks(page, printed, layout.px(1), layout.px(6), layout.line(0.2))
+			layout.drawRegistrationMarks(page)
+
+			label := fmt.Sprintf("%s  page %d/%d  row %d column %d", filepath.Base(config.sourcePath), number, total, row+1, col+1)
+			if err := drawLabel(page, labelFont, label, layout.margin+layout.px(3), layout.pageHeight-layout.margin+layout.px(4)); err != nil {
+				return "", err
+			}
+
+			if err := emit(page, fmt.Sprintf("page-%02d.png", number)); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if pdf != nil {
+		if err := pdf.close(); err != nil {
+			return "", err
+		}
+		if err := buffered.Flush(); err != nil {
+			return "", errors.Wrap(err, "could not write pdf")
+		}
+	}
+
+	log.Printf("print: %d x %d pages of %s\n", layout.cols, layout.rows, config.print)
+
+	return outputName, nil
+}
+
+// drawGuides draws dashed lines where neighbour pages overlap this one
+func (l *printLayout) drawGuides(page *image.RGBA, printed image.Rectangle, col, row int) {
+	thickness := l.line(0.15)
+	dash := l.px(2)
+
+	if col > 0 {
+		dashedLine(page, printed.Min.X+l.overlap, printed.Min.Y, printed.Min.X+l.overlap, printed.Max.Y, thickness, dash)
+	}
+	if col < l.cols-1 {
+		dashedLine(page, printed.Max.X-l.overlap, printed.Min.Y, printed.Max.X-l.overlap, printed.Max.Y, thickness, dash)
+	}
+	if row > 0 {
+		dashedLine(page, printed.Min.X, printed.Min.Y+l.overlap, printed.Max.X, printed.Min.Y+l.overlap, thickness, dash)
+	}
+	if row < l.rows-1 {
+		dashedLine(page, printed.Min.X, printed.Max.Y-l.overlap, printed.Max.X, printed.Max.Y-l.overlap, thickness, dash)
+	}
+}
+
+// drawRegistrationMarks draws a target in every margin
+func (l *printLayout) drawRegistrationMarks(page *image.RGBA) {
+	radius := l.px(2.5)
+	thickness := l.line(0.2)
+	half := l.margin / 2
+
+	// the page label takes the left part of the bottom margin
+	centers := []image.Point{
+		{l.pageWidth * 3 / 4, half},
+		{l.pageWidth * 3 / 4, l.pageHeight - half},
+		{half, l.pageHeight / 2},
+		{l.pageWidth - half, l.pageHeight / 2},
+	}
+
+	for _, c := range centers {
+		circle(page, c, radius, thickness)
+		fillRect(page, image.Rect(c.X-radius-thickness*2, c.Y-thickness/2, c.X+radius+thickness*2, c.Y+thickness/2+1), markColor)
+		fillRect(page, image.Rect(c.X-thickness/2, c.Y-radius-thickness*2, c.X+thickness/2+1, c.Y+radius+thickness*2), markColor)
+	}
+}
+
+// assemblyMap is a page showing a thumbnail of the poster with the
+// grid of pages on top of it
+func (l *printLayout) assemblyMap(ctx *sdlContext, cells []Cell, colors []sdl.Color, font *ttf.Font) (*image.RGBA, error) {
+	page := image.NewRGBA(image.Rect(0, 0, l.pageWidth, l.pageHeight))
+	draw.Draw(page, page.Bounds(), image.White, image.Point{}, draw.Src)
+
+	title := fmt.Sprintf("%s: %d columns x %d rows of %s, overlap %.1fmm, cut along dashed lines",
+		filepath.Base(config.sourcePath), l.cols, l.rows, config.print, config.printOverlap)
+	if err := drawLabel(page, font, title, l.margin, l.margin); err != nil {
+		return nil, err
+	}
+
+	_, labelHeight, err := font.SizeUTF8(title)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get size of label")
+	}
+
+	// every cell becomes one pixel, then stretched to poster proportion
+	padX, padY := config.padding.horizontal, config.padding.vertical
+	cellsImage := image.NewNRGBA(image.Rect(0, 0, config.width+padX*2, config.height+padY*2))
+	draw.Draw(cellsImage, cellsImage.Bounds(), image.NewUniform(imgcolor.NRGBA(config.bgColor)), image.Point{}, draw.Src)
+	for i, c := range colors {
+		cellsImage.Set(cells[i].PixelX/ctx.charWidth, cells[i].PixelY/ctx.charHeight, imgcolor.NRGBA(c))
+	}
+
+	areaTop := l.margin + labelHeight*2
+	scale := math.Min(float64(l.areaWidth)/float64(ctx.winWidth), float64(l.pageHeight-l.margin-areaTop)/float64(ctx.winHeight))
+	thumbWidth := int(float64(ctx.winWidth) * scale)
+	thumbHeight := int(float64(ctx.winHeight) * scale)
+	thumb := resize.Resize(uint(thumbWidth), uint(thumbHeight), cellsImage, resize.NearestNeighbor)
+
+	origin := image.Pt(l.margin+(l.areaWidth-thumbWidth)/2, areaTop)
+	draw.Draw(page, image.Rectangle{origin, origin.Add(image.Pt(thumbWidth, thumbHeight))}, thumb, image.Point{}, draw.Over)
+
+	thickness := l.line(0.3)
+	for row := 0; row < l.rows; row++ {
+		for col := 0; col < l.cols; col++ {
+			region := l.region(col, row).Intersect(image.Rect(0, 0, ctx.winWidth, ctx.winHeight))
+			r := image.Rect(
+				origin.X+int(float64(region.Min.X)*scale), origin.Y+int(float64(region.Min.Y)*scale),
+				origin.X+int(float64(region.Max.X)*scale), origin.Y+int(float64(region.Max.Y)*scale),
+			)
+			outline(page, r, thickness, markColor)
+
+			label := fmt.Sprint(row*l.cols + col + 1)
+			w, h, err := font.SizeUTF8(label)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not get size of label")
+			}
+			center := r.Min.Add(r.Max).Div(2)
+			fillRect(page, image.Rect(center.X-w, center.Y-h/2, center.X+w, center.Y+h/2), imgcolor.NRGBA{0xff, 0xff, 0xff, 0xcc})
+			if err := drawLabel(page, font, label, center.X-w/2, center.Y-h/2); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return page, nil
+}
+
+func drawLabel(dst *image.RGBA, font *ttf.Font, text string, x, y int) error {
+	mask, err := textMask(font, text)
+	if err != nil {
+		return err
+	}
+
+	drawMask(dst, mask, sdl.Color(markColor), image.Pt(x, y))
+
+	return nil
+}
+
+// drawCropMarks draws lines outside the corners of r, offset from it by gap
+func drawCropMarks(dst *image.RGBA, r image.Rectangle, gap, length, thickness int) {
+	for _, x := range []int{r.Min.X, r.Max.X} {
+		for _, y := range []int{r.Min.Y, r.Max.Y} {
+			// horizontal and vertical line pointing away from the corner
+			dx, dy := 1, 1
+			if x == r.Min.X {
+				dx = -1
+			}
+			if y == r.Min.Y {
+				dy = -1
+			}
+
+			fillRect(dst, image.Rect(x+dx*gap, y, x+dx*(gap+length), y+dy*thickness).Canon(), markColor)
+			fillRect(dst, image.Rect(x, y+dy*gap, x+dx*thickness, y+dy*(gap+length)).Canon(), markColor)
+		}
+	}
+}
+
+func fillRect(dst *image.RGBA, r image.Rectangle, c imgcolor.NRGBA) {
+	draw.Draw(dst, r, image.NewUniform(c), image.Point{}, draw.Over)
+}
+
+func outline(dst *image.RGBA, r image.Rectangle, thickness int, c imgcolor.NRGBA) {
+	fillRect(dst, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+thickness), c)
+	fillRect(dst, image.Rect(r.Min.X, r.Max.Y-thickness, r.Max.X, r.Max.Y), c)
+	fillRect(dst, image.Rect(r.Min.X, r.Min.Y, r.Min.X+thickness, r.Max.Y), c)
+	fillRect(dst, image.Rect(r.Max.X-thickness, r.Min.Y, r.Max.X, r.Max.Y), c)
+}
+
+// dashedLine draws a horizontal or vertical dashed line
+func dashedLine(dst *image.RGBA, x0, y0, x1, y1, thickness, dash int) {
+	if y0 == y1 {
+		for x := x0; x < x1; x += dash * 2 {
+			fillRect(dst, image.Rect(x, y0, x+dash, y0+thickness).Intersect(image.Rect(x0, y0, x1, y0+thickness)), guideColor)
+		}
+		return
+	}
+
+	for y := y0; y < y1; y += dash * 2 {
+		fillRect(dst, image.Rect(x0, y, x0+thickness, y+dash).Intersect(image.Rect(x0, y0, x0+thickness, y1)), guideColor)
+	}
+}
+
+func circle(dst *image.RGBA, center image.Point, radius, thickness int) {
+	outer := float64(radius) + float64(thickness)/2
+	inner := float64(radius) - float64(thickness)/2
+
+	for y := center.Y - radius - thickness; y <= center.Y+radius+thickness; y++ {
+		for x := center.X - radius - thickness; x <= center.X+radius+thickness; x++ {
+			d := math.Hypot(float64(x-center.X), float64(y-center.Y))
+			if d >= inner && d <= outer {
+				dst.Set(x, y, markColor)
+			}
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"image"
+	imgcolor "image/color"
+	"image/draw"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/veandco/go-sdl2/sdl"
+	"github.com/veandco/go-sdl2/ttf"
+)
+
+// glyphAtlas holds alpha masks of visible ascii characters rendered
+// once by sdl ttf, so any region of the poster can be drawn in go
+// without a sdl surface of the whole poster
+type glyphAtlas struct {
+	masks [0x7f]*image.Alpha
+}
+
+func newGlyphAtlas(font *ttf.Font) (*glyphAtlas, error) {
+	atlas := &glyphAtlas{}
+
+	for char := byte(0x21); char <= 0x7e; char++ {
+		mask, err := textMask(font, string(char))
+		if err != nil {
+			return nil, err
+		}
+		atlas.masks[char] = mask
+	}
+
+	return atlas, nil
+}
+
+// textMask renders text in white and keeps its alpha channel
+func textMask(font *ttf.Font, text string) (*image.Alpha, error) {
+	surface, err := font.RenderUTF8Blended(text, sdl.Color{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not render font")
+	}
+	defer surface.Free()
+
+	img, err := surfaceToImage(surface)
+	if err != nil {
+		return nil, err
+	}
+
+	mask := image.NewAlpha(img.Bounds())
+	for i := range mask.Pix {
+		mask.Pix[i] = img.Pix[i*4+3]
+	}
+
+	return mask, nil
+}
+
+// overlay is a mask drawn on top of the cells, e.g. a legend
+type overlay struct {
+	mask  *image.Alpha
+	color sdl.Color
+	x, y  int // top left corner in pixels
+}
+
+// textItem is a line of text positioned on the poster
+type textItem struct {
+	text  string
+	color sdl.Color
+	x, y  int       // top left corner in pixels
+	font  *ttf.Font // nil for the poster font
+	width int       // text is clipped to it, 0 for no clipping
+}
+
+func textOverlays(font *ttf.Font, items []textItem) ([]overlay, error) {
+	result := make([]overlay, 0, len(items))
+
+	for _, item := range items {
+		itemFont := font
+		if item.font != nil {
+			itemFont = item.font
+		}
+
+		mask, err := textMask(itemFont, item.text)
+		if err != nil {
+			return nil, err
+		}
+		if item.width > 0 && mask.Bounds().Dx() > item.width {
+			mask = mask.SubImage(image.Rect(0, 0, item.width, mask.Bounds().Dy())).(*image.Alpha)
+		}
+		result = append(result, overlay{mask, item.color, item.x, item.y})
+	}
+
+	return result, nil
+}
+
+// regionRenderer draws any rectangle of the poster in go, it holds
+// cells, colors and glyphs of the whole poster, only pixels are per region
+type regionRenderer struct {
+	ctx      *sdlContext
+	atlas    *glyphAtlas
+	cells    []Cell
+	colors   []sdl.Color
+	overlays []overlay
+	decor    *decorations
+	glyphs   *glyphLayer
+}
+
+func newRegionRenderer(ctx *sdlContext, cells []Cell, colors []sdl.Color, texts []textItem) (*regionRenderer, error) {
+	atlas, err := newGlyphAtlas(ctx.font)
+	if err != nil {
+		return nil, err
+	}
+
+	overlays, err := textOverlays(ctx.font, texts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &regionRenderer{ctx, atlas, cells, colors, overlays, newDecorations(ctx), newGlyphLayer(ctx, atlas, cells)}, nil
+}
+
+// render returns pixels of rect, rect is in poster coordinates and the
+// result starts from (0, 0)
+func (r *regionRenderer) render(rect image.Rectangle) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	r.ctx.background.draw(dst, rect.Min)
+	r.decor.drawShadow(dst, rect.Min)
+
+	if u := r.ctx.underlay; u != nil {
+		draw.Draw(dst, u.Bounds().Sub(rect.Min), u, u.Bounds().Min, draw.Over)
+	}
+
+	r.glyphs.draw(dst, rect, r.colors)
+
+	r.drawCodeFrame(dst, rect)
+	r.decor.drawBorder(dst, rect.Min)
+
+	for _, o := range r.overlays {
+		drawMask(dst, o.mask, o.color, image.Pt(o.x, o.y).Sub(rect.Min))
+	}
+
+	drawVignette(dst, rect.Min, r.ctx.winWidth, r.ctx.winHeight)
+
+	return dst
+}
+
+// drawCodeFrame draws the ring of cells around the content area, they
+// repeat the code like cells in the bleed
+func (r *regionRenderer) drawCodeFrame(dst *image.RGBA, rect image.Rectangle) {
+	frame := config.codeFrame
+	if frame == (padding{}) {
+		return
+	}
+
+	cw, ch := r.ctx.charWidth, r.ctx.charHeight
+	padX, padY := config.padding.horizontal*cw, config.padding.vertical*ch
+
+	minX := clampInt(floorDiv(rect.Min.X-padX, cw)-1, -frame.horizontal, config.width+frame.horizontal-1)
+	maxX := clampInt(floorDiv(rect.Max.X-padX, cw)+1, -frame.horizontal, config.width+frame.horizontal-1)
+	minY := clampInt(floorDiv(rect.Min.Y-padY, ch)-1, -frame.vertical, config.height+frame.vertical-1)
+	maxY := clampInt(floorDiv(rect.Max.Y-padY, ch)+1, -frame.vertical, config.height+frame.vertical-1)
+
+	c := sdl.Color(config.frameColor)
+	for cy := minY; cy <= maxY; cy++ {
+		for cx := minX; cx <= maxX; cx++ {
+			if cx >= 0 && cx < config.width && cy >= 0 && cy < config.height {
+				continue
+			}
+
+			// other layouts may have fewer cells than the grid
+			char := r.cells[mod(mod(cy, config.height)*config.width+mod(cx, config.width), len(r.cells))].Char
+			if mask := r.atlas.masks[char]; mask != nil {
+				drawMask(dst, mask, c, image.Pt(padX+cx*cw, padY+cy*ch).Sub(rect.Min))
+			}
+		}
+	}
+}
+
+// glyphLayer draws the glyph of every cell centered on the cell and
+// rotated by its angle, whatever layout placed it
+type glyphLayer struct {
+	atlas   *glyphAtlas
+	glyphs  []placedGlyph
+	reach   int                   // farthest a rotated glyph goes from its center
+	buckets map[image.Point][]int // glyph indexes by their center
+	rotated map[rotatedKey]*image.Alpha
+}
+
+type placedGlyph struct {
+	x, y  int // center in pixels
+	angle float64
+	char  byte
+	color int // index of the cell whose color is used
+}
+
+type rotatedKey struct {
+	char  byte
+	angle int // whole degrees
+}
+
+// glyphs are bucketed so a region only looks at the glyphs near it
+const glyphBucketSize = 256
+
+func newGlyphLayer(ctx *sdlContext, atlas *glyphAtlas, cells []Cell) *glyphLayer {
+	l := &glyphLayer{
+		atlas:   atlas,
+		buckets: make(map[image.Point][]int),
+		rotated: make(map[rotatedKey]*image.Alpha),
+	}
+
+	for i, cell := range cells {
+		l.glyphs = append(l.glyphs, placedGlyph{cell.PixelX, cell.PixelY, cell.Angle, cell.Char, i})
+	}
+
+	if layout, ok := ctx.layout.(bleedLayout); ok && config.bleed > 0 {
+		area := image.Rect(0, 0, ctx.winWidth, ctx.winHeight).Inset(-mmToPixels(config.bleed))
+		for _, cell := range layout.BleedCells(area) {
+			l.glyphs = append(l.glyphs, placedGlyph{cell.PixelX, cell.PixelY, cell.Angle, cells[cell.char].Char, cell.color})
+		}
+	}
+
+	for _, mask := range atlas.masks {
+		if mask != nil {
+			b := mask.Bounds()
+			l.reach = maxInt(l.reach, int(math.Ceil(math.Hypot(float64(b.Dx()), float64(b.Dy()))/2))+1)
+		}
+	}
+
+	for i, g := range l.glyphs {
+		key := image.Pt(floorDiv(g.x, glyphBucketSize), floorDiv(g.y, glyphBucketSize))
+		l.buckets[key] = append(l.buckets[key], i)
+	}
+
+	return l
+}
+
+func (l *glyphLayer) draw(dst *image.RGBA, rect image.Rectangle, colors []sdl.Color) {
+	area := rect.Inset(-l.reach)
+
+	var indexes []int
+	for by := floorDiv(area.Min.Y, glyphBucketSize); by <= floorDiv(area.Max.Y, glyphBucketSize); by++ {
+		for bx := floorDiv(area.Min.X, glyphBucketSize); bx <= floorDiv(area.Max.X, glyphBucketSize); bx++ {
+			indexes = append(indexes, l.buckets[image.Pt(bx, by)]...)
+		}
+	}
+
+	// overlapping glyphs are drawn in the same order in every region
+	sort.Ints(indexes)
+
+	for _, i := range indexes {
+		g := l.glyphs[i]
+		if !image.Pt(g.x, g.y).In(area) {
+			continue
+		}
+
+		mask := l.mask(g.char, g.angle)
+		if mask == nil {
+			continue
+		}
+
+		drawMask(dst, mask, colors[g.color], image.Pt(g.x, g.y).Sub(rect.Min))
+	}
+}
+
+// mask returns the glyph of char rotated by angle, its bounds are
+// centered on (0, 0)
+func (l *glyphLayer) mask(char byte, angle float64) *image.Alpha {
+	if int(char) >= len(l.atlas.masks) || l.atlas.masks[char] == nil {
+		return nil
+	}
+
+	key := rotatedKey{char, mod(int(math.Round(angle)), 360)}
+	if mask, ok := l.rotated[key]; ok {
+		return mask
+	}
+
+	src := l.atlas.masks[char]
+	b := src.Bounds()
+	center := image.Pt(b.Min.X+b.Dx()/2, b.Min.Y+b.Dy()/2)
+
+	var result *image.Alpha
+	if key.angle == 0 {
+		result = &image.Alpha{Pix: src.Pix, Stride: src.Stride, Rect: b.Sub(center)}
+	} else {
+		result = rotateMask(src, float64(key.angle), l.reach)
+	}
+
+	l.rotated[key] = result
+	return result
+}
+
+// rotateMask turns mask clockwise about its center, each pixel samples
+// the source bilinearly at its inverse rotation
+func rotateMask(mask *image.Alpha, angle float64, reach int) *image.Alpha {
+	b := mask.Bounds()
+	cx, cy := float64(b.Min.X)+float64(b.Dx())/2, float64(b.Min.Y)+float64(b.Dy())/2
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+
+	at := func(x, y int) float64 {
+		if !image.Pt(x, y).In(b) {
+			return 0
+		}
+		return float64(mask.Pix[mask.PixOffset(x, y)])
+	}
+
+	result := image.NewAlpha(image.Rect(-reach, -reach, reach, reach))
+	for v := -reach; v < reach; v++ {
+		for u := -reach; u < reach; u++ {
+			du, dv := float64(u)+0.5, float64(v)+0.5
+			sx := du*cos + dv*sin + cx - 0.5
+			sy := -du*sin + dv*cos + cy - 0.5
+
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			fx, fy := sx-float64(x0), sy-float64(y0)
+
+			top := at(x0, y0)*(1-fx) + at(x0+1, y0)*fx
+			bottom := at(x0, y0+1)*(1-fx) + at(x0+1, y0+1)*fx
+			result.Pix[result.PixOffset(u, v)] = clamp8(top*(1-fy) + bottom*fy)
+		}
+	}
+
+	return result
+}
+
+func drawMask(dst draw.Image, mask *image.Alpha, c sdl.Color, at image.Point) {
+	bounds := mask.Bounds().Add(at)
+	if !bounds.Overlaps(dst.Bounds()) {
+		return
+	}
+
+	draw.DrawMask(dst, bounds, image.NewUniform(imgcolor.NRGBA(c)), image.Point{}, mask, mask.Bounds().Min, draw.Over)
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+func mod(a, b int) int {
+	return (a%b + b) % b
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// samples per pixel side used to anti-alias shape edges
+const shapeSamples = 4
+
+// star inner radius relative to outer radius
+const starInnerRadius = 0.45
+
+// ring inner radius relative to outer radius
+const ringInnerRadius = 0.6
+
+// generateImage draws the shape and/or gradient selected by config
+// at exact content resolution
+func generateImage(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	fill := func(x, y int) sdl.Color {
+		return sdl.Color(config.fill)
+	}
+	if len(config.gradient) > 0 {
+		fill = func(x, y int) sdl.Color {
+			return gradientAt(config.gradient, gradientPosition(config.gradientType, config.angle, width, height, x, y))
+		}
+	}
+
+	var inside func(u, v float64) bool
+	if config.shape != "" {
+		inside = shapeFunc(config.shape, config.sides)
+	}
+
+	// shape coordinates, unit circle fits in the image
+	cx, cy := float64(width)/2, float64(height)/2
+	scale := math.Min(cx, cy) * 0.95
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := fill(x, y)
+
+			if inside != nil {
+				covered := 0
+				for sy := 0; sy < shapeSamples; sy++ {
+					for sx := 0; sx < shapeSamples; sx++ {
+						u := (float64(x) + (float64(sx)+0.5)/shapeSamples - cx) / scale
+						v := (cy - float64(y) - (float64(sy)+0.5)/shapeSamples) / scale
+						if inside(u, v) {
+							covered++
+						}
+					}
+				}
+				c.A = uint8(int(c.A) * covered / (shapeSamples * shapeSamples))
+			}
+
+			i := img.PixOffset(x, y)
+			img.Pix[i] = c.R
+			img.Pix[i+1] = c.G
+			img.Pix[i+2] = c.B
+			img.Pix[i+3] = c.A
+		}
+	}
+
+	return img
+}
+
+// shapeFunc reports whether a point is inside the shape, u goes right
+// and v goes up, the shape fits in the unit circle
+func shapeFunc(shape string, sides int) func(u, v float64) bool {
+	switch shape {
+	case "circle":
+		return func(u, v float64) bool {
+			return u*u+v*v <= 1
+		}
+
+	case "ring":
+		return func(u, v float64) bool {
+			d := u*u + v*v
+			return d <= 1 && d >= ringInnerRadius*ringInnerRadius
+		}
+
+	case "heart":
+		return func(u, v float64) bool {
+			// (x^2 + y^2 - 1)^3 - x^2 y^3 <= 0, which spans about
+			// x in [-1.14, 1.14] and y in [-1, 1.25]
+			x := u * 1.2
+			y := v*1.2 + 0.1
+			a := x*x + y*y - 1
+			return a*a*a-x*x*y*y*y <= 0
+		}
+
+	case "star":
+		return polygonFunc(regularPolygon(sides, starInnerRadius))
+
+	default:
+		return polygonFunc(regularPolygon(sides, 1))
+	}
+}
+
+// regularPolygon returns vertices of a polygon pointing up, if inner
+// is less than 1 every other vertex is moved inward to make a star
+func regularPolygon(sides int, inner float64) [][2]float64 {
+	if sides < 3 {
+		sides = 3
+	}
+
+	n := sides
+	if inner < 1 {
+		n = sides * 2
+	}
+
+	result := make([][2]float64, n)
+	for i := range result {
+		r := 1.0
+		if inner < 1 && i%2 == 1 {
+			r = inner
+		}
+		a := math.Pi/2 + 2*math.Pi*float64(i)/float64(n)
+		result[i] = [2]float64{r * math.Cos(a), r * math.Sin(a)}
+	}
+
+	return result
+}
+
+// even-odd rule
+func polygonFunc(points [][2]float64) func(u, v float64) bool {
+	return func(u, v float64) bool {
+		inside := false
+		for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+			a, b := points[i], points[j]
+			if (a[1] > v) != (b[1] > v) &&
+				u < (b[0]-a[0])*(v-a[1])/(b[1]-a[1])+a[0] {
+				inside = !inside
+			}
+		}
+		return inside
+	}
+}
+
+// gradientPosition maps a pixel to [0, 1] according to gradient type and angle,
+// angle 0 goes from left to right and increases clockwise
+func gradientPosition(gradientType string, angle float64, width, height, x, y int) float64 {
+	rad := angle * math.Pi / 180
+	dx := float64(x) + 0.5 - float64(width)/2
+	dy := float64(y) + 0.5 - float64(height)/2
+
+	switch gradientType {
+	case "radial":
+		maxDist := math.Hypot(float64(width)/2, float64(height)/2)
+		return math.Hypot(dx, dy) / maxDist
+
+	case "conic":
+		a := math.Atan2(dy, dx) - rad
+		a = math.Mod(a+4*math.Pi, 2*math.Pi)
+		return a / (2 * math.Pi)
+
+	default:
+		cos, sin := math.Cos(rad), math.Sin(rad)
+		extent := math.Abs(float64(width)/2*cos) + math.Abs(float64(height)/2*sin)
+		return ((dx*cos+dy*sin)/extent + 1) / 2
+	}
+}
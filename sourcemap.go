@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type sourceMap struct {
+	Image      string          `json:"image"`
+	Layout     string          `json:"layout"`
+	Width      int             `json:"width"`  // in chars, the longest row
+	Height     int             `json:"height"` // in chars, number of rows
+	CharWidth  int             `json:"charWidth"`
+	CharHeight int             `json:"charHeight"`
+	Cells      []sourceMapCell `json:"cells"` // row by row, or line by line for non-grid layouts
+}
+
+type sourceMapCell struct {
+	X      int     `json:"x"`
+	Y      int     `json:"y"`
+	File   string  `json:"file"`
+	Line   int     `json:"line"`
+	Column int     `json:"column"`
+	Char   string  `json:"char"`
+	Rect   [4]int  `json:"rect"`            // x, y, w, h in pixels
+	Angle  float64 `json:"angle,omitempty"` // clockwise in degrees
+}
+
+// writeSourceMap writes cell to source position mapping as json,
+// or as csv if path ends with .csv
+func writeSourceMap(path string, ctx *sdlContext, cells []Cell, image string) error {
+	width, height := gridSize(cells)
+	m := sourceMap{
+		Image:      image,
+		Layout:     config.layout,
+		Width:      width,
+		Height:     height,
+		CharWidth:  ctx.charWidth,
+		CharHeight: ctx.charHeight,
+		Cells:      make([]sourceMapCell, len(cells)),
+	}
+
+	for i, cell := range cells {
+		file := cell.File
+		if abs, err := filepath.Abs(file); err == nil {
+			file = abs
+		}
+
+		m.Cells[i] = sourceMapCell{
+			X:      cell.GridX,
+			Y:      cell.GridY,
+			File:   file,
+			Line:   cell.Line,
+			Column: cell.Column,
+			Char:   string(cell.Char),
+			Rect: [4]int{
+				cell.PixelX - cell.Width/2,
+				cell.PixelY - cell.Height/2,
+				cell.Width,
+				cell.Height,
+			},
+			Angle: cell.Angle,
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "could not create source map")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = writeSourceMapCSV(w, &m)
+	} else {
+		err = json.NewEncoder(w).Encode(&m)
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not write source map")
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "could not write source map")
+	}
+
+	return nil
+}
+
+func writeSourceMapCSV(w *bufio.Writer, m *sourceMap) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"x", "y", "file", "line", "column", "char", "pixel_x", "pixel_y", "pixel_w", "pixel_h", "angle"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	itoa := strconv.Itoa
+	for _, c := range m.Cells {
+		record := []string{
+			itoa(c.X), itoa(c.Y), c.File, itoa(c.Line), itoa(c.Column), c.Char,
+			itoa(c.Rect[0]), itoa(c.Rect[1]), itoa(c.Rect[2]), itoa(c.Rect[3]),
+			strconv.FormatFloat(c.Angle, 'f', -1, 64),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
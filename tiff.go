@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// tiffWriter writes a deflate compressed cmyk tiff strip by strip,
+// the directory is written at the end and the header patched to point to it,
+// offsets are 32 bits so the file may not grow past 4 GiB
+type tiffWriter struct {
+	w            io.WriteSeeker
+	offset       int64
+	width        int
+	height       int
+	rowsPerStrip int
+	dpi          int
+	stripOffsets []uint32
+	stripLengths []uint32
+}
+
+func newTIFFWriter(w io.WriteSeeker, width, height, rowsPerStrip, dpi int) (*tiffWriter, error) {
+	t := &tiffWriter{w: w, width: width, height: height, rowsPerStrip: rowsPerStrip, dpi: dpi}
+
+	// little endian, magic 42, offset of directory filled by close
+	if err := t.write([]byte{'I', 'I', 42, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *tiffWriter) write(b []byte) error {
+	if t.offset+int64(len(b)) > math.MaxUint32 {
+		return errors.Errorf("tiff would be larger than 4 GiB, try a lower --dpi or --format=pdf")
+	}
+
+	n, err := t.w.Write(b)
+	t.offset += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "could not write tiff")
+	}
+
+	return nil
+}
+
+// writeStrip writes rowsPerStrip rows of cmyk samples, the last
+// strip may be shorter
+func (t *tiffWriter) writeStrip(samples []byte) error {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(samples); err != nil {
+		return errors.Wrap(err, "could not compress tiff strip")
+	}
+	if err := zw.Close(); err != nil {
+		return errors.Wrap(err, "could not compress tiff strip")
+	}
+
+	t.stripOffsets = append(t.stripOffsets, uint32(t.offset))
+	t.stripLengths = append(t.stripLengths, uint32(buf.Len()))
+
+	return t.write(buf.Bytes())
+}
+
+const (
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+type tiffEntry struct {
+	tag    uint16
+	kind   uint16
+	values []uint32 // a rational takes two values
+}
+
+func (t *tiffWriter) close() error {
+	if t.offset%2 == 1 {
+		if err := t.write([]byte{0}); err != nil {
+			return err
+		}
+	}
+
+	entries := []tiffEntry{
+		{256, tiffLong, []uint32{uint32(t.width)}},
+		{257, tiffLong, []uint32{uint32(t.height)}},
+		{258, tiffShort, []uint32{8, 8, 8, 8}}, // bits per sample
+		{259, tiffShort, []uint32{8}},          // compression: deflate
+		{262, tiffShort, []uint32{5}},          // photometric: separated
+		{273, tiffLong, t.stripOffsets},
+		{277, tiffShort, []uint32{4}}, // samples per pixel
+		{278, tiffLong, []uint32{uint32(t.rowsPerStrip)}},
+		{279, tiffLong, t.stripLengths},
+		{282, tiffRational, []uint32{uint32(t.dpi), 1}},
+		{283, tiffRational, []uint32{uint32(t.dpi), 1}},
+		{284, tiffShort, []uint32{1}}, // planar config: chunky
+		{296, tiffShort, []uint32{2}}, // resolution unit: inch
+		{332, tiffShort, []uint32{1}}, // ink set: cmyk
+	}
+
+	directory := uint32(t.offset)
+	size := uint32(2 + len(entries)*12 + 4)
+
+	// values not fitting in 4 bytes follow the directory
+	var dir, extra bytes.Buffer
+	le := binary.LittleEndian
+
+	binary.Write(&dir, le, uint16(len(entries)))
+	for _, e := range entries {
+		var data bytes.Buffer
+		for _, v := range e.values {
+			if e.kind == tiffShort {
+				binary.Write(&data, le, uint16(v))
+			} else {
+				binary.Write(&data, le, v)
+			}
+		}
+
+		count := uint32(len(e.values))
+		if e.kind == tiffRational {
+			count /= 2
+		}
+
+		binary.Write(&dir, le, e.tag)
+		binary.Write(&dir, le, e.kind)
+		binary.Write(&dir, le, count)
+
+		if data.Len() <= 4 {
+			dir.Write(data.Bytes())
+			dir.Write(make([]byte, 4-data.Len()))
+		} else {
+			binary.Write(&dir, le, directory+size+uint32(extra.Len()))
+			extra.Write(data.Bytes())
+		}
+	}
+	binary.Write(&dir, le, uint32(0)) // no next directory
+
+	if err := t.write(append(dir.Bytes(), extra.Bytes()...)); err != nil {
+		return err
+	}
+
+	if _, err := t.w.Seek(4, io.SeekStart); err != nil {
+		return errors.Wrap(err, "could not write tiff")
+	}
+
+	var header [4]byte
+	le.PutUint32(header[:], directory)
+	if _, err := t.w.Write(header[:]); err != nil {
+		return errors.Wrap(err, "could not write tiff")
+	}
+
+	return nil
+}
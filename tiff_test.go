@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+// tiffFile writes samples of a width x height cmyk image, rowsPerStrip
+// rows at a time, and returns the file content
+func tiffFile(t *testing.T, samples []byte, width, height, rowsPerStrip int) []byte {
+	f, err := ioutil.TempFile("", "codeposter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := newTIFFWriter(f, width, height, rowsPerStrip, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stripSize := width * rowsPerStrip * 4
+	for start := 0; start < len(samples); start += stripSize {
+		if err := w.writeStrip(samples[start:minInt(start+stripSize, len(samples))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTIFFWriter(t *testing.T) {
+	const width, height, rowsPerStrip = 3, 5, 2
+	samples := make([]byte, width*height*4)
+	for i := range samples {
+		samples[i] = byte(i * 7)
+	}
+
+	data := tiffFile(t, samples, width, height, rowsPerStrip)
+	le := binary.LittleEndian
+
+	if !bytes.Equal(data[:4], []byte{'I', 'I', 42, 0}) {
+		t.Fatalf("header is % x", data[:4])
+	}
+	directory := le.Uint32(data[4:8])
+	if directory%2 != 0 {
+		t.Errorf("directory at odd offset %d", directory)
+	}
+
+	// values of every entry, offsets followed for values not fitting in
+	// the entry
+	entries := make(map[uint16][]uint32)
+	count := int(le.Uint16(data[directory:]))
+	lastTag := uint16(0)
+	for i := 0; i < count; i++ {
+		e := data[int(directory)+2+i*12:]
+		tag, kind, n := le.Uint16(e), le.Uint16(e[2:]), le.Uint32(e[4:])
+		if tag <= lastTag {
+			t.Errorf("tag %d after %d, tags should be ascending", tag, lastTag)
+		}
+		lastTag = tag
+
+		size := map[uint16]int{tiffShort: 2, tiffLong: 4, tiffRational: 8}[kind]
+		value := e[8:12]
+		if int(n)*size > 4 {
+			value = data[le.Uint32(e[8:]):]
+		}
+
+		// a rational is read as two longs
+		var values []uint32
+		if kind == tiffShort {
+			for k := 0; k < int(n)*size; k += 2 {
+				values = append(values, uint32(le.Uint16(value[k:])))
+			}
+		} else {
+			for k := 0; k < int(n)*size; k += 4 {
+				values = append(values, le.Uint32(value[k:]))
+			}
+		}
+		entries[tag] = values
+	}
+	if next := le.Uint32(data[int(directory)+2+count*12:]); next != 0 {
+		t.Errorf("next directory is %d, want 0", next)
+	}
+
+	want := map[uint16][]uint32{
+		256: {width},
+		257: {height},
+		258: {8, 8, 8, 8},
+		259: {8},
+		262: {5},
+		277: {4},
+		278: {rowsPerStrip},
+		282: {300, 1},
+		283: {300, 1},
+		296: {2},
+	}
+	for tag, values := range want {
+		got := entries[tag]
+		if len(got) != len(values) {
+			t.Errorf("tag %d is %v, want %v", tag, got, values)
+			continue
+		}
+		for i := range values {
+			if got[i] != values[i] {
+				t.Errorf("tag %d is %v, want %v", tag, got, values)
+				break
+			}
+		}
+	}
+
+	// strips decompress back to the samples
+	offsets, lengths := entries[273], entries[279]
+	if len(offsets) != 3 || len(lengths) != 3 {
+		t.Fatalf("strip offsets %v and lengths %v, want 3 strips", offsets, lengths)
+	}
+	var decoded []byte
+	for i := range offsets {
+		r, err := zlib.NewReader(bytes.NewReader(data[offsets[i] : offsets[i]+lengths[i]]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		strip, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, strip...)
+	}
+	if !bytes.Equal(decoded, samples) {
+		t.Error("strips do not decompress to the samples")
+	}
+}
+
+func TestTIFFWriterOverflow(t *testing.T) {
+	f, err := ioutil.TempFile("", "codeposter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := newTIFFWriter(f, 1, 1, 1, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pretend the strips so far filled the file up to the 32 bits limit
+	w.offset = math.MaxUint32 - 4
+	if err := w.writeStrip(make([]byte, 4)); err == nil {
+		t.Error("strip past 4 GiB should fail")
+	}
+}
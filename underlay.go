@@ -0,0 +1,59 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+func checkUnderlay() error {
+	if config.underlay < 0 || config.underlay > 1 {
+		return errors.New("underlay should be between 0 and 1")
+	}
+
+	if config.underlayBlur < 0 {
+		return errors.New("underlay blur should not be negative")
+	}
+
+	if config.format == "html" && config.underlay > 0 {
+		log.Println("underlay is not drawn in html")
+	}
+
+	return nil
+}
+
+// newUnderlay is the source image drawn faintly under the code, pixels
+// taken as background are left out, its bounds are in poster coordinates
+func newUnderlay(src *sourceImage, blurRadius int) *image.RGBA {
+	if config.underlay == 0 {
+		return nil
+	}
+
+	w, h := src.img.Bounds().Max.X, src.img.Bounds().Max.Y
+
+	// room for the blur to spread past the image
+	margin := 3 * blurRadius
+	img := image.NewNRGBA(image.Rect(0, 0, w+2*margin, h+2*margin))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := pixelColor(src.img, x, y)
+			if c.A == 0 || src.isBackground(x, y, c) {
+				continue
+			}
+
+			i := img.PixOffset(x+margin, y+margin)
+			img.Pix[i] = c.R
+			img.Pix[i+1] = c.G
+			img.Pix[i+2] = c.B
+			img.Pix[i+3] = clamp8(float64(c.A) * config.underlay)
+		}
+	}
+
+	result := image.NewRGBA(image.Rect(0, 0, w, h).Add(src.at).Inset(-margin))
+	draw.Draw(result, result.Bounds(), blur(img, blurRadius), image.Point{}, draw.Src)
+
+	return result
+}